@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The .env next to docker-compose.yml sets where Immich keeps its files and database, which release
+// runs and the Postgres password. Lines are kept as they are, comments included, and only the
+// variables that change are rewritten.
+
+const composeEnvFile = ".env"
+
+// The password in Immich's example .env, which every install starts out with
+const exampleDBPassword = "postgres"
+
+type envLine struct {
+	raw     string
+	key     string // empty for comments and blank lines
+	value   string
+	comment string // an inline " # ..." after an unquoted value
+}
+
+type EnvFile struct {
+	lines []envLine
+}
+
+var envKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnvFile reads KEY=value lines the way Docker Compose does: an optional "export ", single or
+// double quoted values, and inline comments after unquoted values
+func parseEnvFile(b []byte) *EnvFile {
+	env := &EnvFile{}
+	text := strings.ReplaceAll(string(b), "\r\n", "\n")
+	text = strings.TrimSuffix(text, "\n")
+	if text == "" {
+		return env
+	}
+	for _, raw := range strings.Split(text, "\n") {
+		line := envLine{raw: raw}
+		trimmed := strings.TrimPrefix(strings.TrimSpace(raw), "export ")
+		key, value, ok := strings.Cut(trimmed, "=")
+		key = strings.TrimSpace(key)
+		if ok && !strings.HasPrefix(trimmed, "#") && envKeyRe.MatchString(key) {
+			line.key = key
+			line.value, line.comment = parseEnvValue(strings.TrimSpace(value))
+		}
+		env.lines = append(env.lines, line)
+	}
+	return env
+}
+
+func parseEnvValue(value string) (string, string) {
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') {
+		if end := strings.IndexByte(value[1:], value[0]); end >= 0 {
+			unquoted := value[1 : end+1]
+			if value[0] == '"' {
+				unquoted = strings.NewReplacer(`\"`, `"`, `\\`, `\`, `\n`, "\n").Replace(unquoted)
+			}
+			return unquoted, strings.TrimSpace(value[end+2:])
+		}
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		return strings.TrimSpace(value[:i]), strings.TrimSpace(value[i:])
+	}
+	return value, ""
+}
+
+func (e *EnvFile) Get(key string) (string, bool) {
+	for _, line := range e.lines {
+		if line.key == key {
+			return line.value, true
+		}
+	}
+	return "", false
+}
+
+// Set changes key in place, or adds it at the end
+func (e *EnvFile) Set(key, value string) {
+	for i, line := range e.lines {
+		if line.key != key {
+			continue
+		}
+		if line.value == value {
+			return
+		}
+		line.value = value
+		line.raw = key + "=" + quoteEnvValue(value)
+		if line.comment != "" {
+			line.raw += " " + line.comment
+		}
+		e.lines[i] = line
+		return
+	}
+	e.lines = append(e.lines, envLine{raw: key + "=" + quoteEnvValue(value), key: key, value: value})
+}
+
+// quoteEnvValue only quotes values that would read back differently unquoted
+func quoteEnvValue(value string) string {
+	if value == "" || !strings.ContainsAny(value, " \t#'\"\\$\n") {
+		return value
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+func (e *EnvFile) Bytes() []byte {
+	var buf bytes.Buffer
+	for _, line := range e.lines {
+		buf.WriteString(line.raw)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// ComposeEnv is the part of the .env the admin panel shows. The storage locations are the ZFS
+// datasets from the setup guide and moving them means moving the data, so they're only displayed.
+type ComposeEnv struct {
+	UploadLocation  string
+	DBDataLocation  string
+	ImmichVersion   string
+	DBPasswordSet   bool // the password itself is never shown
+	NeedsDBPassword bool // the database hasn't been created yet and still has the example password
+
+	env *EnvFile
+}
+
+type ComposeEnvForm struct {
+	*ComposeEnv
+	Error string
+	Saved bool
+}
+
+func (c *ComposeEnv) Form() ComposeEnvForm {
+	return ComposeEnvForm{ComposeEnv: c}
+}
+
+func composeEnvPath() string {
+	return filepath.Join(immichDir, composeEnvFile)
+}
+
+// loadComposeEnv reads the .env. A missing file is the same as an empty one.
+func loadComposeEnv(path string) (*ComposeEnv, error) {
+	slog.Debug("loadComposeEnv()", "path", path)
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Debug("Error reading compose .env", "err", err)
+		return nil, err
+	}
+
+	env := parseEnvFile(b)
+	config := &ComposeEnv{env: env}
+	config.UploadLocation, _ = env.Get("UPLOAD_LOCATION")
+	config.DBDataLocation, _ = env.Get("DB_DATA_LOCATION")
+	config.ImmichVersion, _ = env.Get("IMMICH_VERSION")
+	password, _ := env.Get("DB_PASSWORD")
+	config.DBPasswordSet = password != ""
+	config.NeedsDBPassword = (password == "" || password == exampleDBPassword) && !databaseInitialized(config.DBDataLocation)
+	return config, nil
+}
+
+// databaseInitialized reports whether Postgres has created its data directory. From then on the
+// password is stored in the database, changing it in the .env would lock Immich out.
+func databaseInitialized(dataLocation string) bool {
+	if dataLocation == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(dataLocation, "PG_VERSION"))
+	return err == nil
+}
+
+// Docker image tags, e.g. release, v1.132.3
+var imageTagRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+
+func validateComposeEnv(config *ComposeEnv) error {
+	if !imageTagRe.MatchString(config.ImmichVersion) {
+		return fmt.Errorf("Immich version %q must be \"release\" or a version tag like v1.132.3", config.ImmichVersion)
+	}
+	return nil
+}
+
+// Postgres is only reliable with alphanumeric passwords in the compose setup, Immich's docs say so too
+const dbPasswordChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+func generateDBPassword() (string, error) {
+	password := make([]byte, 32) // ~190 bits
+	for i := range password {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(dbPasswordChars))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = dbPasswordChars[n.Int64()]
+	}
+	return string(password), nil
+}
+
+// saveComposeEnv writes the changed fields back, generating a database password first if the database
+// doesn't exist yet and would otherwise be created with the example one
+func saveComposeEnv(path string, config *ComposeEnv) error {
+	slog.Debug("saveComposeEnv()")
+	config.env.Set("IMMICH_VERSION", config.ImmichVersion)
+	if config.NeedsDBPassword {
+		password, err := generateDBPassword()
+		if err != nil {
+			return err
+		}
+		config.env.Set("DB_PASSWORD", password)
+		config.DBPasswordSet, config.NeedsDBPassword = true, false
+		slog.Info("Generated a database password for Immich")
+	}
+
+	// It holds the database password, keep whatever permissions it has or make it private
+	mode := fs.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, config.env.Bytes(), mode); err != nil {
+		slog.Debug("Error writing compose .env", "err", err)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Line-based diff used to preview what applying configuration.tmp will change
+
+type DiffLine struct {
+	Op      string `json:"op"` // "equal", "add" or "remove"
+	OldLine int    `json:"oldLine,omitempty"`
+	NewLine int    `json:"newLine,omitempty"`
+	Text    string `json:"text"`
+}
+
+type DiffHunk struct {
+	OldStart int        `json:"oldStart"`
+	NewStart int        `json:"newStart"`
+	Lines    []DiffLine `json:"lines"`
+}
+
+type ConfigDiff struct {
+	OldFile string     `json:"oldFile"`
+	NewFile string     `json:"newFile"`
+	Added   int        `json:"added"`
+	Removed int        `json:"removed"`
+	Hunks   []DiffHunk `json:"hunks"`
+}
+
+func (d *ConfigDiff) Changed() bool {
+	return d.Added > 0 || d.Removed > 0
+}
+
+const diffContext = 3 // unchanged lines shown around each change
+
+func splitLines(s string) []string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines computes a minimal line diff using the longest common subsequence. Config files are a few
+// hundred lines at most so the quadratic table is not a concern.
+func diffLines(a, b []string) []DiffLine {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []DiffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, DiffLine{Op: "equal", OldLine: i + 1, NewLine: j + 1, Text: a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, DiffLine{Op: "remove", OldLine: i + 1, Text: a[i]})
+			i++
+		default:
+			lines = append(lines, DiffLine{Op: "add", NewLine: j + 1, Text: b[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+// groupHunks drops unchanged lines that are more than diffContext lines away from a change
+func groupHunks(lines []DiffLine) []DiffHunk {
+	keep := make([]bool, len(lines))
+	for i, line := range lines {
+		if line.Op == "equal" {
+			continue
+		}
+		for k := max(0, i-diffContext); k <= min(len(lines)-1, i+diffContext); k++ {
+			keep[k] = true
+		}
+	}
+
+	var hunks []DiffHunk
+	var current *DiffHunk
+	oldLine, newLine := 1, 1
+	for i, line := range lines {
+		if keep[i] {
+			if current == nil {
+				hunks = append(hunks, DiffHunk{OldStart: oldLine, NewStart: newLine})
+				current = &hunks[len(hunks)-1]
+			}
+			current.Lines = append(current.Lines, line)
+		} else {
+			current = nil
+		}
+		if line.Op != "add" {
+			oldLine++
+		}
+		if line.Op != "remove" {
+			newLine++
+		}
+	}
+	return hunks
+}
+
+func diffFiles(oldPath, newPath string) (*ConfigDiff, error) {
+	slog.Debug("diffFiles()", "old", oldPath, "new", newPath)
+	oldContent, err := os.ReadFile(oldPath)
+	if err != nil {
+		slog.Debug("Error reading file:", "err", err)
+		return nil, err
+	}
+	newContent, err := os.ReadFile(newPath)
+	if err != nil {
+		slog.Debug("Error reading file:", "err", err)
+		return nil, err
+	}
+
+	return diffContents(oldPath, newPath, oldContent, newContent), nil
+}
+
+// diffContents diffs content that has already been read, labelled with the paths it came from
+func diffContents(oldPath, newPath string, oldContent, newContent []byte) *ConfigDiff {
+	lines := diffLines(splitLines(string(oldContent)), splitLines(string(newContent)))
+	diff := &ConfigDiff{OldFile: oldPath, NewFile: newPath, Hunks: groupHunks(lines)}
+	for _, line := range lines {
+		switch line.Op {
+		case "add":
+			diff.Added++
+		case "remove":
+			diff.Removed++
+		}
+	}
+	return diff
+}
+
+// diffSavedConfig compares each module's saved-but-not-applied .tmp with the live .nix. A module that
+// isn't live yet is compared against an empty file.
+func diffSavedConfig() ([]*ConfigDiff, error) {
+	slog.Debug("diffSavedConfig()")
+	var diffs []*ConfigDiff
+	for _, module := range nixModules {
+		livePath := module.Path(nixDir, ".nix")
+		if _, err := os.Stat(livePath); errors.Is(err, fs.ErrNotExist) {
+			livePath = os.DevNull
+		}
+		diff, err := diffFiles(livePath, module.Path(nixDir, ".tmp"))
+		if err != nil {
+			return nil, err
+		}
+		diff.OldFile, diff.NewFile = module.Name, module.Name
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
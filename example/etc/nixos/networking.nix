@@ -1,10 +1,7 @@
 { config, pkgs, ... }:
 
-let
-  hostName = "immich-dev-vm";
-in
 {
-  networking.hostName = hostName;
+  networking.hostName = "immich-dev-vm";
 
   # networking.domain = ".local";
   # networking.enableIPv6 = false;
@@ -14,7 +11,7 @@ in
   services.avahi = {
     enable = true;
     openFirewall = true;
-    hostName = hostName;
+    hostName = "immich-dev-vm";
     publish = {
       #userServices = true;
       enable = true;
@@ -38,7 +35,7 @@ in
   # Caddy (reverse proxy)
   services.caddy.enable = true;
   services.caddy = {
-    virtualHosts."${hostName}.local:80".extraConfig = ''
+    virtualHosts."immich-dev-vm.local:80".extraConfig = ''
       reverse_proxy http://localhost:2283
     '';
     virtualHosts.":8080".extraConfig = ''
@@ -0,0 +1,15 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, lib, pkgs, ... }:
+
+{
+  # OpenSSH on the LAN (Tailscale SSH is set up separately in remoteaccess.nix). Defaults so the
+  # same settings in admin.nix don't conflict, the web UI refuses an admin.nix that sets them differently.
+  services.openssh.enable = lib.mkDefault true;
+  services.openssh.openFirewall = lib.mkDefault true;
+  services.openssh.settings.PasswordAuthentication = lib.mkDefault true;
+  services.openssh.settings.KbdInteractiveAuthentication = lib.mkDefault true;
+  services.openssh.settings.PermitRootLogin = lib.mkDefault "yes";
+
+  users.users.root.openssh.authorizedKeys.keys = [
+  ];
+}
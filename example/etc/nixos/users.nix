@@ -0,0 +1,18 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, pkgs, ... }:
+
+{
+  # Users without a hashedPassword keep the password they already have
+  users.users = {
+    admin = {
+      isNormalUser = true;
+      description = "Admin";
+      extraGroups = [ "networkmanager" "wheel" ];
+      openssh.authorizedKeys.keys = [
+      ];
+    };
+  };
+
+  # Used by the web UI to hash new passwords
+  environment.systemPackages = with pkgs; [ mkpasswd ];
+}
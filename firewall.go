@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	immichPort = 80   // Caddy in front of Immich
+	adminPort  = 8080 // Caddy in front of this web UI
+)
+
+// Firewall is the part of NetworkingSettings that ends up in networking.firewall. When AdminSubnets is
+// set the admin port is only opened to those subnets, through extraCommands, instead of to everyone.
+type Firewall struct {
+	AllowPing    bool
+	TCPPorts     []int
+	UDPPorts     []int
+	AdminSubnets []string // CIDR, empty means the admin UI is reachable from anywhere the port is open
+}
+
+// OpenTCPPorts is what goes in allowedTCPPorts. A restricted admin port is opened by extraCommands
+// instead, otherwise allowedTCPPorts would open it to everyone anyway.
+func (f Firewall) OpenTCPPorts() []int {
+	if len(f.AdminSubnets) == 0 {
+		return f.TCPPorts
+	}
+	var ports []int
+	for _, port := range f.TCPPorts {
+		if port != adminPort {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// AdminRules are the iptables commands that open the admin port to each subnet. A closed admin port
+// stays closed.
+func (f Firewall) AdminRules() []string {
+	if !slices.Contains(f.TCPPorts, adminPort) {
+		return nil
+	}
+	var rules []string
+	for _, subnet := range f.AdminSubnets {
+		cmd := "iptables"
+		if prefix, err := netip.ParsePrefix(subnet); err == nil && prefix.Addr().Is6() {
+			cmd = "ip6tables"
+		}
+		rules = append(rules, fmt.Sprintf("%s -A nixos-fw -p tcp --dport %d -s %s -j nixos-fw-accept", cmd, adminPort, subnet))
+	}
+	return rules
+}
+
+var adminRuleRe = regexp.MustCompile(`--dport ` + strconv.Itoa(adminPort) + ` -s (\S+) -j nixos-fw-accept`)
+
+func loadFirewall(l *settingLoader, config *NixConfig) error {
+	config.AllowPing = true // NixOS answers pings unless told otherwise
+	if err := l.Bool("AllowPing", "networking.firewall.allowPing", &config.AllowPing); err != nil {
+		return err
+	}
+	if err := l.Ints("TCPPorts", "networking.firewall.allowedTCPPorts", &config.TCPPorts); err != nil {
+		return err
+	}
+	if node := l.Optional("UDPPorts", "networking.firewall.allowedUDPPorts"); node != nil {
+		ports, err := nixIntList(node)
+		if err != nil {
+			return err
+		}
+		config.UDPPorts = ports
+	}
+
+	config.AdminSubnets = nil
+	if node := l.Optional("AdminSubnets", "networking.firewall.extraCommands"); node != nil {
+		commands, err := nixStringValue(node)
+		if err != nil {
+			return err
+		}
+		for _, match := range adminRuleRe.FindAllStringSubmatch(commands, -1) {
+			config.AdminSubnets = append(config.AdminSubnets, match[1])
+		}
+		// The rules replace the admin port in allowedTCPPorts, show it as open in the form
+		if len(config.AdminSubnets) > 0 && !slices.Contains(config.TCPPorts, adminPort) {
+			config.TCPPorts = append(config.TCPPorts, adminPort)
+			sort.Ints(config.TCPPorts)
+		}
+	}
+	return nil
+}
+
+// parsePorts reads a comma or space separated list of ports
+func parsePorts(value string) ([]int, error) {
+	var ports []int
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		port, err := strconv.Atoi(field)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("%q is not a port number between 1 and 65535", field)
+		}
+		if !slices.Contains(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
+
+// parseFirewallForm reads the firewall fields of the admin form
+func parseFirewallForm(r *http.Request) (Firewall, error) {
+	tcp, tcpErr := parsePorts(r.FormValue("tcp-ports"))
+	udp, udpErr := parsePorts(r.FormValue("udp-ports"))
+	firewall := Firewall{
+		AllowPing: parseBool(r.FormValue("allow-ping")),
+		TCPPorts:  tcp,
+		UDPPorts:  udp,
+	}
+
+	errs := []error{tcpErr, udpErr}
+	for _, field := range strings.FieldsFunc(r.FormValue("admin-subnets"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			// A bare address means just that host
+			addr, addrErr := netip.ParseAddr(field)
+			if addrErr != nil {
+				errs = append(errs, fmt.Errorf("%q is not a subnet (e.g. 192.168.1.0/24) or address", field))
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		firewall.AdminSubnets = append(firewall.AdminSubnets, prefix.Masked().String())
+	}
+	return firewall, errors.Join(errs...)
+}
+
+// clientAddr is the address a request came from. Caddy proxies the admin UI, so the forwarded
+// address is the real client.
+func clientAddr(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// firewallWarnings lists the ways a firewall config would cut off the admin UI or Immich for the
+// client that's saving it. They don't block saving, an admin on the console may mean to do this.
+func firewallWarnings(firewall Firewall, client string) []string {
+	var warnings []string
+	if !slices.Contains(firewall.TCPPorts, adminPort) {
+		warnings = append(warnings, fmt.Sprintf("Port %d is closed. The admin UI will only be reachable from the server itself.", adminPort))
+	} else if len(firewall.AdminSubnets) > 0 {
+		addr, err := netip.ParseAddr(client)
+		allowed := false
+		for _, subnet := range firewall.AdminSubnets {
+			if prefix, err := netip.ParsePrefix(subnet); err == nil && addr.IsValid() && prefix.Contains(addr.Unmap()) {
+				allowed = true
+			}
+		}
+		if err == nil && addr.IsLoopback() {
+			allowed = true
+		}
+		if !allowed {
+			warnings = append(warnings, fmt.Sprintf("Your address %s is not in the allowed admin subnets. You will lose access to the admin UI once this is applied.", client))
+		}
+	}
+	if !slices.Contains(firewall.TCPPorts, immichPort) {
+		warnings = append(warnings, fmt.Sprintf("Port %d is closed. Immich will not be reachable from the network.", immichPort))
+	}
+	return warnings
+}
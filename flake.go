@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// In flake mode the system is built from flake.nix, with nixpkgs pinned by flake.lock. The lock only
+// moves when an admin bumps it from the UI, and the new lock goes through the same validate and apply
+// flow as any other change. Auto upgrades rebuild the pinned revision without updating it.
+
+const flakeHost = "immich" // nixosConfigurations attribute in flake.nix, independent of the hostname
+
+// Nix on a fresh install doesn't have flakes enabled yet, system.nix turns them on after the first switch
+var flakeFeatures = []string{"--extra-experimental-features", "nix-command flakes"}
+
+// FlakeLock is the nixpkgs revision a flake.lock is pinned to
+type FlakeLock struct {
+	Ref          string // branch the input follows, e.g. nixos-24.11
+	Rev          string
+	LastModified time.Time
+}
+
+func (l *FlakeLock) ShortRev() string {
+	if len(l.Rev) > 7 {
+		return l.Rev[:7]
+	}
+	return l.Rev
+}
+
+// readFlakeLock pulls the nixpkgs input out of a flake.lock
+func readFlakeLock(path string) (*FlakeLock, error) {
+	slog.Debug("readFlakeLock()", "path", path)
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var lock struct {
+		Root  string `json:"root"`
+		Nodes map[string]struct {
+			Inputs map[string]any `json:"inputs"`
+			Locked struct {
+				Rev          string `json:"rev"`
+				LastModified int64  `json:"lastModified"`
+			} `json:"locked"`
+			Original struct {
+				Ref string `json:"ref"`
+			} `json:"original"`
+		} `json:"nodes"`
+	}
+	if err := json.Unmarshal(b, &lock); err != nil {
+		slog.Debug("Error parsing flake.lock", "err", err)
+		return nil, err
+	}
+
+	// The root node maps input names to node names, which are usually but not always the same
+	nodeName, ok := lock.Nodes[lock.Root].Inputs["nixpkgs"].(string)
+	if !ok {
+		return nil, fmt.Errorf("%s has no nixpkgs input", filepath.Base(path))
+	}
+	node, ok := lock.Nodes[nodeName]
+	if !ok {
+		return nil, fmt.Errorf("%s has no node %q", filepath.Base(path), nodeName)
+	}
+	return &FlakeLock{
+		Ref:          node.Original.Ref,
+		Rev:          node.Locked.Rev,
+		LastModified: time.Unix(node.Locked.LastModified, 0),
+	}, nil
+}
+
+// rebuildArgs returns the nixos-rebuild arguments to build the config in dir, using the flake if there is one
+func rebuildArgs(dir string, action string) []string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	if _, err := os.Stat(filepath.Join(abs, "flake.nix")); err == nil {
+		// path: rather than a plain path so a git repo in /etc/nixos doesn't hide untracked modules
+		return []string{action, "--flake", "path:" + abs + "#" + flakeHost, "--option", "extra-experimental-features", "nix-command flakes"}
+	}
+	return []string{action, "-I", "nixos-config=" + filepath.Join(abs, "configuration.nix")}
+}
+
+// lockFlake runs `nix flake <args>` against the saved flake.nix and writes the resulting lock to dst.
+// The live flake.lock (or lockSrc, if given) is the starting point so inputs stay pinned unless args
+// say otherwise.
+func lockFlake(lockSrc string, dst string, args ...string) error {
+	scratch, err := os.MkdirTemp("", "nixos-flake-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(scratch)
+
+	if err := CopyFile(nixDir+"flake.tmp", filepath.Join(scratch, "flake.nix")); err != nil {
+		slog.Debug("Error copying saved flake.nix", "err", err)
+		return err
+	}
+	if lockSrc == "" {
+		lockSrc = nixDir + "flake.lock"
+	}
+	err = CopyFile(lockSrc, filepath.Join(scratch, "flake.lock"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Debug("Error copying flake.lock", "err", err)
+		return err
+	}
+
+	out, err := runCommand(context.Background(), scratch, "nix", append(flakeFeatures, append([]string{"flake"}, args...)...)...)
+	if err != nil {
+		slog.Debug("| error locking flake |", "args", args, "output", string(out), "err", err)
+		return fmt.Errorf("nix flake %s failed: %w", args[0], err)
+	}
+	return CopyFile(filepath.Join(scratch, "flake.lock"), dst)
+}
+
+// stageFlakeLock is the Stage hook for flake.lock. It locks any inputs that aren't locked yet and
+// leaves the rest as they are.
+func stageFlakeLock(config *NixConfig, tmpPath string) error {
+	slog.Debug("stageFlakeLock()")
+	return lockFlake("", tmpPath, "lock")
+}
+
+// stageFlakeUpdate bumps nixpkgs in the saved flake.lock. If nothing is saved the live config is staged
+// first, so the update can be reviewed, validated and applied on its own.
+func stageFlakeUpdate() error {
+	slog.Debug("stageFlakeUpdate()")
+	if !hasSavedConfig() {
+		config, err := loadBaseConfig()
+		if err != nil {
+			return err
+		}
+		if err := saveTmpFile(config); err != nil {
+			return err
+		}
+	}
+
+	tmpPath := nixDir + "flake.lock.tmp"
+	removed, err := isRemoved(tmpPath)
+	if err != nil {
+		return err
+	}
+	if removed {
+		return fmt.Errorf("flake mode is not enabled in the saved configuration")
+	}
+	if err := lockFlake(tmpPath, tmpPath, "update", "nixpkgs"); err != nil {
+		return err
+	}
+	slog.Info("Staged nixpkgs update")
+	return nil
+}
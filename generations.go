@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NixOS system generations, read from the profile links in /nix/var/nix/profiles
+
+const profileDir = "/nix/var/nix/profiles"
+
+type Generation struct {
+	Number       int
+	Link         string // system-42-link
+	Date         time.Time
+	NixOSVersion string
+	Kernel       string
+	Current      bool
+}
+
+var (
+	generationLinkRe = regexp.MustCompile(`^system-(\d+)-link$`)
+	kernelVersionRe  = regexp.MustCompile(`-linux-(\d[^/]*)/`)
+)
+
+// listGenerations reads the system generations in dir, newest first. dir is a parameter so this can
+// be pointed at a fixture directory.
+func listGenerations(dir string) ([]Generation, error) {
+	slog.Debug("listGenerations()", "dir", dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Debug("Error reading profile directory", "err", err)
+		return nil, err
+	}
+
+	current, _ := os.Readlink(filepath.Join(dir, "system"))
+
+	var generations []Generation
+	for _, entry := range entries {
+		match := generationLinkRe.FindStringSubmatch(entry.Name())
+		if match == nil {
+			continue
+		}
+		number, _ := strconv.Atoi(match[1])
+		path := filepath.Join(dir, entry.Name())
+
+		gen := Generation{Number: number, Link: entry.Name(), Current: entry.Name() == current}
+		if info, err := os.Lstat(path); err == nil {
+			gen.Date = info.ModTime()
+		}
+		if b, err := os.ReadFile(filepath.Join(path, "nixos-version")); err == nil {
+			gen.NixOSVersion, _ = parseNixosVersion(string(b))
+		}
+		if target, err := os.Readlink(filepath.Join(path, "kernel")); err == nil {
+			gen.Kernel = parseKernelVersion(target)
+		}
+		generations = append(generations, gen)
+	}
+
+	sort.Slice(generations, func(i, j int) bool {
+		return generations[i].Number > generations[j].Number
+	})
+	return generations, nil
+}
+
+// parseNixosVersion splits `nixos-version` output such as "24.11.20250105.2f3e4a1 (Vicuna)" into the
+// version and codename. The nixos-version file inside a generation only has the version.
+func parseNixosVersion(out string) (string, string) {
+	out = strings.TrimSpace(out)
+	version, codename, found := strings.Cut(out, " ")
+	if !found {
+		return version, ""
+	}
+	return version, strings.Trim(strings.TrimSpace(codename), "()")
+}
+
+// parseKernelVersion pulls the version out of a generation's kernel link, which points at something
+// like /nix/store/<hash>-linux-6.6.52/bzImage
+func parseKernelVersion(target string) string {
+	match := kernelVersionRe.FindStringSubmatch(target)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+func rollbackGeneration() error {
+	slog.Debug("rollbackGeneration()")
+	unlock, err := lockSystem()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if getPending() != nil {
+		return errPending
+	}
+	out, err := runCommand(context.Background(), "/", "nixos-rebuild", "switch", "--rollback")
+	if err != nil {
+		slog.Debug("| error running 'nixos-rebuild switch --rollback' |", "output", string(out), "err", err)
+		return fmt.Errorf("failed to roll back: %w", err)
+	}
+	slog.Info("Rolled back to the previous generation.")
+	return nil
+}
+
+// switchGeneration points the system profile at an existing generation and activates it
+func switchGeneration(number int) error {
+	slog.Debug("switchGeneration()", "number", number)
+	unlock, err := lockSystem()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if getPending() != nil {
+		return errPending
+	}
+	generations, err := listGenerations(profileDir)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, gen := range generations {
+		if gen.Number == number {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("generation %d does not exist", number)
+	}
+
+	profile := filepath.Join(profileDir, "system")
+	out, err := runCommand(context.Background(), "/", "nix-env", "--profile", profile, "--switch-generation", strconv.Itoa(number))
+	if err != nil {
+		slog.Debug("| error switching profile generation |", "output", string(out), "err", err)
+		return fmt.Errorf("failed to switch to generation %d: %w", number, err)
+	}
+
+	out, err = runCommand(context.Background(), "/", filepath.Join(profile, "bin", "switch-to-configuration"), "switch")
+	if err != nil {
+		slog.Debug("| error activating generation |", "output", string(out), "err", err)
+		return fmt.Errorf("failed to activate generation %d: %w", number, err)
+	}
+
+	slog.Info("Switched generation", "number", number)
+	return nil
+}
+
+// collectGenerations deletes all but the newest keep generations, garbage collects the store and
+// refreshes the boot menu so it stops listing the deleted generations
+func collectGenerations(keep int) error {
+	slog.Debug("collectGenerations()", "keep", keep)
+	unlock, err := lockSystem()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if getPending() != nil {
+		return errPending
+	}
+	if keep < 1 {
+		return fmt.Errorf("at least one generation must be kept")
+	}
+
+	profile := filepath.Join(profileDir, "system")
+	steps := [][]string{
+		{"nix-env", "--profile", profile, "--delete-generations", "+" + strconv.Itoa(keep)},
+		{"nix-store", "--gc"},
+		// From the profile, not /run/current-system, so the boot default stays where the profile points
+		{filepath.Join(profile, "bin", "switch-to-configuration"), "boot"},
+	}
+	for _, step := range steps {
+		out, err := runCommand(context.Background(), "/", step[0], step[1:]...)
+		if err != nil {
+			slog.Debug("| error collecting generations |", "cmd", step, "output", string(out), "err", err)
+			return fmt.Errorf("%s failed: %w", step[0], err)
+		}
+	}
+
+	slog.Info("Old generations removed", "kept", keep)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestListGenerations(t *testing.T) {
+	generations, err := listGenerations("testdata/generations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Generation{
+		{Number: 10, Link: "system-10-link"},
+		{Number: 2, Link: "system-2-link", NixOSVersion: "24.11.20250105.2f3e4a1", Kernel: "6.6.69", Current: true},
+		{Number: 1, Link: "system-1-link", NixOSVersion: "24.05.20240601.abc1234", Kernel: "6.6.32"},
+	}
+	if len(generations) != len(want) {
+		t.Fatalf("got %d generations, want %d: %+v", len(generations), len(want), generations)
+	}
+	for i, gen := range generations {
+		gen.Date = want[i].Date // git doesn't keep the links' times
+		if gen != want[i] {
+			t.Errorf("generation %d = %+v, want %+v", i, gen, want[i])
+		}
+	}
+}
+
+func TestParseNixosVersion(t *testing.T) {
+	tests := []struct {
+		out, version, codename string
+	}{
+		{"24.11.20250105.2f3e4a1 (Vicuna)\n", "24.11.20250105.2f3e4a1", "Vicuna"},
+		{"24.05.20240601.abc1234", "24.05.20240601.abc1234", ""},
+		{"25.05pre-git (Warbler)", "25.05pre-git", "Warbler"},
+		{"", "", ""},
+	}
+	for _, test := range tests {
+		version, codename := parseNixosVersion(test.out)
+		if version != test.version || codename != test.codename {
+			t.Errorf("parseNixosVersion(%q) = %q, %q, want %q, %q", test.out, version, codename, test.version, test.codename)
+		}
+	}
+}
+
+func TestParseKernelVersion(t *testing.T) {
+	tests := []struct {
+		target, version string
+	}{
+		{"/nix/store/3c4d-linux-6.6.69/bzImage", "6.6.69"},
+		{"/nix/store/5e6f-linux-6.12.8-rc1/bzImage", "6.12.8-rc1"},
+		{"/nix/store/9c0d-linux-6.6.69", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if version := parseKernelVersion(test.target); version != test.version {
+			t.Errorf("parseKernelVersion(%q) = %q, want %q", test.target, version, test.version)
+		}
+	}
+}
+
+func TestGenerationsRefusedWhilePending(t *testing.T) {
+	pending.Lock()
+	pending.apply = &PendingApply{}
+	pending.Unlock()
+	t.Cleanup(func() {
+		pending.Lock()
+		pending.apply = nil
+		pending.Unlock()
+	})
+
+	if err := rollbackGeneration(); !errors.Is(err, errPending) {
+		t.Errorf("rollbackGeneration() = %v", err)
+	}
+	if err := switchGeneration(1); !errors.Is(err, errPending) {
+		t.Errorf("switchGeneration() = %v", err)
+	}
+	if err := collectGenerations(3); !errors.Is(err, errPending) {
+		t.Errorf("collectGenerations() = %v", err)
+	}
+}
+
+// Collecting garbage rewrites the boot menu from the system profile, a running system that was
+// switched to an older generation mustn't become the boot default
+func TestGarbageCollectionKeepsBootDefault(t *testing.T) {
+	var commands []string
+	runCommand = func(ctx context.Context, dir string, name string, args ...string) ([]byte, error) {
+		commands = append(commands, name+" "+strings.Join(args, " "))
+		return nil, nil
+	}
+	t.Cleanup(func() { runCommand = execCommand })
+
+	if err := collectGenerations(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := collectGarbage(30); err != nil {
+		t.Fatal(err)
+	}
+	boot := "/nix/var/nix/profiles/system/bin/switch-to-configuration boot"
+	if len(commands) != 5 || commands[2] != boot || commands[4] != boot {
+		t.Errorf("ran %q, want each collection to end with %s", commands, boot)
+	}
+}
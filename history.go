@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// Every applied configuration is kept in historyDir, one directory per revision holding copies of the
+// files plus a revision.json describing who applied it and how it went
+
+const (
+	revisionNixOS  = "nixos"
+	revisionImmich = "immich"
+)
+
+type Revision struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	AppliedBy string    `json:"appliedBy"`
+	Kind      string    `json:"kind"`
+	Result    string    `json:"result"`
+	Message   string    `json:"message,omitempty"`
+	Files     []string  `json:"files"`
+}
+
+var revisionIDRe = regexp.MustCompile(`^\d{8}-\d{6}\.\d{3}$`)
+
+// requestActor describes who made a request. There's no login, so this is the basic auth user if
+// Caddy is doing auth, otherwise the client address.
+func requestActor(r *http.Request) string {
+	if user, _, ok := r.BasicAuth(); ok && user != "" {
+		return user
+	}
+	return clientAddr(r)
+}
+
+func revisionDir(id string) string {
+	return filepath.Join(historyDir, id)
+}
+
+// recordRevision copies the given files (name in the revision -> source path) into a new revision.
+// Missing sources are skipped so an immich-config.json that doesn't exist yet doesn't block an apply,
+// and Immich configs are stored with the smtp password redacted.
+func recordRevision(kind string, actor string, result string, files map[string]string) (*Revision, error) {
+	slog.Debug("recordRevision()", "kind", kind)
+	rev := &Revision{
+		ID:        time.Now().UTC().Format("20060102-150405.000"),
+		Time:      time.Now(),
+		AppliedBy: actor,
+		Kind:      kind,
+		Result:    result,
+	}
+
+	dir := revisionDir(rev.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil { // users.nix holds password hashes
+		slog.Debug("Error creating revision directory", "err", err)
+		return nil, err
+	}
+
+	for name, src := range files {
+		b, err := readRedacted(name, src)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Debug("Skipping missing file for revision", "file", src)
+			continue
+		}
+		if err != nil {
+			slog.Debug("Error reading file for revision", "err", err)
+			return nil, err
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), b, 0600); err != nil {
+			slog.Debug("Error writing file into revision", "err", err)
+			return nil, err
+		}
+		rev.Files = append(rev.Files, name)
+	}
+	sort.Strings(rev.Files)
+
+	if err := writeRevision(rev); err != nil {
+		return nil, err
+	}
+	slog.Info("Recorded configuration revision", "id", rev.ID, "kind", kind)
+	return rev, nil
+}
+
+// redactedPassword stands in for the smtp password in stored and displayed Immich configs
+const redactedPassword = "********"
+
+// readRedacted reads a config file with secrets blanked out, so it can be stored in the history or
+// shown. Only immich-config.json has any; the JSON is rewritten with just the password changed.
+func readRedacted(name string, path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil || name != "immich-config.json" {
+		return b, err
+	}
+	immich, err := parseImmichConfig(b)
+	if err != nil {
+		return nil, err
+	}
+	if immich.Notifications.SMTP.Transport.Password == "" {
+		return b, nil
+	}
+	immich.Notifications.SMTP.Transport.Password = redactedPassword
+	return immich.Marshal()
+}
+
+func writeRevision(rev *Revision) error {
+	b, err := json.MarshalIndent(rev, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(revisionDir(rev.ID), "revision.json"), b, 0600); err != nil {
+		slog.Debug("Error writing revision.json", "err", err)
+		return err
+	}
+	return nil
+}
+
+func getRevision(id string) (*Revision, error) {
+	if !revisionIDRe.MatchString(id) {
+		return nil, fmt.Errorf("invalid revision id %q", id)
+	}
+	b, err := os.ReadFile(filepath.Join(revisionDir(id), "revision.json"))
+	if err != nil {
+		return nil, err
+	}
+	var rev Revision
+	if err := json.Unmarshal(b, &rev); err != nil {
+		return nil, err
+	}
+	return &rev, nil
+}
+
+// updateRevision records the outcome of an apply once it's known. Errors are only logged, the
+// history is informational and shouldn't get in the way of the apply itself.
+func updateRevision(id string, result string, message string) {
+	if id == "" {
+		return
+	}
+	rev, err := getRevision(id)
+	if err != nil {
+		slog.Error("| Error reading revision |", "id", id, "err", err)
+		return
+	}
+	rev.Result = result
+	rev.Message = message
+	if err := writeRevision(rev); err != nil {
+		slog.Error("| Error updating revision |", "id", id, "err", err)
+	}
+}
+
+// listRevisions returns every revision, newest first
+func listRevisions() ([]*Revision, error) {
+	slog.Debug("listRevisions()")
+	entries, err := os.ReadDir(historyDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []*Revision
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		rev, err := getRevision(entry.Name())
+		if err != nil {
+			slog.Debug("Skipping unreadable revision", "dir", entry.Name(), "err", err)
+			continue
+		}
+		revisions = append(revisions, rev)
+	}
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].ID > revisions[j].ID
+	})
+	return revisions, nil
+}
+
+// revisionFilePath returns the stored copy of a file in a revision
+func revisionFilePath(rev *Revision, name string) (string, error) {
+	for _, f := range rev.Files {
+		if f == name {
+			return filepath.Join(revisionDir(rev.ID), name), nil
+		}
+	}
+	return "", fmt.Errorf("revision %s has no %s: %w", rev.ID, name, fs.ErrNotExist)
+}
+
+// savedRevisionFiles lists what goes into a NixOS revision: each saved module under its live name, and
+// the Immich config as it was at the time. Modules that are off in the saved config are left out.
+func savedRevisionFiles() map[string]string {
+	files := map[string]string{"immich-config.json": tankImmich + "immich-config.json"}
+	for _, module := range nixModules {
+		tmpPath := module.Path(nixDir, ".tmp")
+		if removed, err := isRemoved(tmpPath); err == nil && removed {
+			continue
+		}
+		files[module.Name] = tmpPath
+	}
+	return files
+}
+
+// The live file each stored file corresponds to
+func liveConfigPath(name string) string {
+	if name == "immich-config.json" {
+		return tankImmich + "immich-config.json"
+	}
+	for _, module := range nixModules {
+		if module.Name == name {
+			return module.Path(nixDir, ".nix")
+		}
+	}
+	return ""
+}
+
+// diffRevision compares each file in a revision with the live file. A file that isn't live, like
+// flake.nix outside flake mode, is compared against an empty one. Both sides are redacted, as the live
+// file and revisions recorded before redaction hold the password.
+func diffRevision(rev *Revision) ([]*ConfigDiff, error) {
+	var diffs []*ConfigDiff
+	for _, name := range rev.Files {
+		stored, _ := revisionFilePath(rev, name)
+		storedContent, err := readRedacted(name, stored)
+		if err != nil {
+			return nil, err
+		}
+		livePath := liveConfigPath(name)
+		liveContent, err := readRedacted(name, livePath)
+		if errors.Is(err, fs.ErrNotExist) {
+			livePath, liveContent, err = os.DevNull, nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		diffs = append(diffs, diffContents(livePath, stored, liveContent, storedContent))
+	}
+	return diffs, nil
+}
+
+// restoreRevision brings back a past revision. NixOS modules are staged as .tmp files so they go
+// through the usual validate and apply flow, Immich configs are written straight back.
+func restoreRevision(rev *Revision, actor string) error {
+	slog.Debug("restoreRevision()", "id", rev.ID)
+	switch rev.Kind {
+	case revisionNixOS:
+		restored := 0
+		for _, module := range nixModules {
+			src, err := revisionFilePath(rev, module.Name)
+			if errors.Is(err, fs.ErrNotExist) {
+				if module.Enabled != nil {
+					// Optional modules that weren't there at the time are switched off
+					if err := os.WriteFile(module.Path(nixDir, ".tmp"), nil, 0644); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if err := CopyFile(src, module.Path(nixDir, ".tmp")); err != nil {
+				return err
+			}
+			restored++
+		}
+		if restored == 0 {
+			// Revisions from before the config was split into modules only hold configuration.nix
+			return fmt.Errorf("revision %s has no NixOS modules to restore", rev.ID)
+		}
+		return nil
+	case revisionImmich:
+		src, err := revisionFilePath(rev, "immich-config.json")
+		if err != nil {
+			return err
+		}
+		b, err := os.ReadFile(src)
+		if err != nil {
+			return err
+		}
+		immich, err := parseImmichConfig(b)
+		if err != nil {
+			return err
+		}
+		if immich.Notifications.SMTP.Transport.Password == redactedPassword {
+			// The stored copy is redacted, keep the password that's set now
+			immich.Notifications.SMTP.Transport.Password = ""
+			if current, err := os.ReadFile(tankImmich + "immich-config.json"); err == nil {
+				if live, err := parseImmichConfig(current); err == nil {
+					immich.Notifications.SMTP.Transport.Password = live.Notifications.SMTP.Transport.Password
+				}
+			}
+		}
+		if err := writeImmichConfig(immich); err != nil {
+			return err
+		}
+		restored, err := recordRevision(revisionImmich, actor, "restored", map[string]string{"immich-config.json": tankImmich + "immich-config.json"})
+		if err != nil {
+			return err
+		}
+		updateRevision(restored.ID, "restored", "Restored from revision "+rev.ID)
+		return nil
+	}
+	return fmt.Errorf("unknown revision kind %q", rev.Kind)
+}
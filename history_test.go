@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// useScratchHistory points historyDir at a temp dir
+func useScratchHistory(t *testing.T) {
+	t.Helper()
+	previous := historyDir
+	historyDir = t.TempDir() + "/"
+	t.Cleanup(func() { historyDir = previous })
+}
+
+// A revision saved outside flake mode has no flake files, and diffs even though they aren't live
+func TestNixOSRevisionWithoutFlake(t *testing.T) {
+	config := stageSavedConfig(t)
+	if config.Flake {
+		t.Fatal("the dev config is expected to use channels")
+	}
+	useScratchHistory(t)
+
+	rev, err := recordRevision(revisionNixOS, "test", "applied", savedRevisionFiles())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(rev.Files, "flake.nix") || slices.Contains(rev.Files, "flake.lock") {
+		t.Errorf("revision recorded modules that are off: %q", rev.Files)
+	}
+	if !slices.Contains(rev.Files, "system.nix") {
+		t.Errorf("revision is missing system.nix: %q", rev.Files)
+	}
+
+	// A module that was live then and has since gone
+	if err := os.Remove(nixDir + "users.nix"); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := diffRevision(rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diffs) != len(rev.Files) {
+		t.Errorf("got %d diffs for %d files", len(diffs), len(rev.Files))
+	}
+}
+
+// The smtp password never leaves immich-config.json: not into the history, a diff or a shown file
+func TestImmichRevisionRedactsPassword(t *testing.T) {
+	useScratchHistory(t)
+	previous := tankImmich
+	tankImmich = t.TempDir() + "/"
+	t.Cleanup(func() { tankImmich = previous })
+
+	b, err := os.ReadFile("testdata/immich-config.full.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	immich, err := parseImmichConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	immich.Notifications.SMTP.Transport.Password = "hunter2"
+	if err := writeImmichConfig(immich); err != nil {
+		t.Fatal(err)
+	}
+
+	rev, err := recordRevision(revisionImmich, "test", "saved", map[string]string{"immich-config.json": tankImmich + "immich-config.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := revisionFilePath(rev, "immich-config.json")
+	info, err := os.Stat(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("stored with mode %v, want 0600", info.Mode().Perm())
+	}
+	storedContent, err := os.ReadFile(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(storedContent), "hunter2") || !strings.Contains(string(storedContent), redactedPassword) {
+		t.Errorf("stored copy isn't redacted:\n%s", storedContent)
+	}
+
+	// Change the password so the diff has something to show
+	immich.Notifications.SMTP.Transport.Password = "correct horse"
+	if err := writeImmichConfig(immich); err != nil {
+		t.Fatal(err)
+	}
+	diffs, err := diffRevision(rev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, diff := range diffs {
+		for _, hunk := range diff.Hunks {
+			for _, line := range hunk.Lines {
+				if strings.Contains(line.Text, "correct horse") {
+					t.Errorf("diff shows the live password: %q", line.Text)
+				}
+			}
+		}
+	}
+
+	// Restoring keeps the password that's set now instead of writing the placeholder
+	if err := restoreRevision(rev, "test"); err != nil {
+		t.Fatal(err)
+	}
+	b, err = os.ReadFile(tankImmich + "immich-config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := parseImmichConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restored.Notifications.SMTP.Transport.Password; got != "correct horse" {
+		t.Errorf("restored password = %q, want the current one", got)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A host update runs `nixos-rebuild switch --upgrade` in the background. Its output is kept in memory
+// so the page can stream it, and so reloading the page (or opening it in a second tab) picks the log
+// up from the start. Only the tail is kept, a release upgrade with -L can print hundreds of megabytes.
+
+const hostUpdateTimeout = 2 * time.Hour // a NixOS release upgrade can rebuild a lot
+
+const hostUpdateLogLimit = 4 << 20 // bytes of output kept, failures show up at the end
+
+// commandStreamer runs an external command in dir, writing its combined output to out as it arrives.
+// Like runCommand it's a variable so dev machines can swap in a fake.
+type commandStreamer func(ctx context.Context, dir string, out io.Writer, name string, args ...string) error
+
+var streamCommand commandStreamer = execStream
+
+func execStream(ctx context.Context, dir string, out io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}
+
+type HostUpdate struct {
+	Started        time.Time
+	Finished       time.Time // zero while running
+	Err            string
+	PrevGeneration int
+	Generation     int    // generation the system is on once the update finished
+	Log            string // only set on snapshots
+
+	mu      sync.Mutex
+	output  []byte
+	dropped int           // bytes cut from the front of output to stay under hostUpdateLogLimit
+	changed chan struct{} // closed and replaced on every write, wakes up readers
+}
+
+func (u *HostUpdate) Running() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.Finished.IsZero()
+}
+
+func (u *HostUpdate) Write(p []byte) (int, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.output = append(u.output, p...)
+	if over := len(u.output) - hostUpdateLogLimit; over > 0 {
+		u.output = u.output[over:]
+		u.dropped += over
+	}
+	close(u.changed)
+	u.changed = make(chan struct{})
+	return len(p), nil
+}
+
+// droppedNotice stands in for the output that was cut from the front of the log
+func droppedNotice(dropped int) string {
+	return fmt.Sprintf("[%d bytes of earlier output not kept]\n", dropped)
+}
+
+// Output returns what was written after offset (counted from the very first byte written), the offset
+// to continue from, whether the update has finished, and a channel that is closed on the next write
+func (u *HostUpdate) Output(offset int) ([]byte, int, bool, <-chan struct{}) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var out []byte
+	if offset < u.dropped {
+		out = []byte(droppedNotice(u.dropped - offset))
+	}
+	out = append(out, u.output[min(max(offset-u.dropped, 0), len(u.output)):]...)
+	return out, u.dropped + len(u.output), !u.Finished.IsZero(), u.changed
+}
+
+func (u *HostUpdate) finish(err error) {
+	generation := generationNumber(currentGeneration())
+	u.mu.Lock()
+	u.Finished = time.Now()
+	u.Generation = generation
+	if err != nil {
+		u.Err = err.Error()
+	}
+	close(u.changed)
+	u.changed = make(chan struct{})
+	u.mu.Unlock()
+}
+
+// Snapshot copies the fields and the log so far, so a page can be rendered while the update is writing
+func (u *HostUpdate) Snapshot() HostUpdate {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	log := string(u.output)
+	if u.dropped > 0 {
+		log = droppedNotice(u.dropped) + log
+	}
+	return HostUpdate{
+		Started:        u.Started,
+		Finished:       u.Finished,
+		Err:            u.Err,
+		PrevGeneration: u.PrevGeneration,
+		Generation:     u.Generation,
+		Log:            log,
+	}
+}
+
+func (u *HostUpdate) Duration() time.Duration {
+	return u.Finished.Sub(u.Started).Round(time.Second)
+}
+
+// Only the latest update is kept
+var hostUpdate struct {
+	sync.Mutex
+	job *HostUpdate
+}
+
+// generationNumber returns 42 for "system-42-link", or 0
+func generationNumber(link string) int {
+	match := generationLinkRe.FindStringSubmatch(link)
+	if match == nil {
+		return 0
+	}
+	number, _ := strconv.Atoi(match[1])
+	return number
+}
+
+func latestHostUpdate() *HostUpdate {
+	hostUpdate.Lock()
+	defer hostUpdate.Unlock()
+	return hostUpdate.job
+}
+
+func hostUpdateRunning() bool {
+	job := latestHostUpdate()
+	return job != nil && job.Running()
+}
+
+// startHostUpdate starts an upgrade unless one is already running or an applied config is still
+// waiting to be confirmed, since switching now would make that config permanent
+func startHostUpdate() (*HostUpdate, error) {
+	slog.Debug("startHostUpdate()")
+	unlock, err := lockSystem() // held until the update finishes
+	if err != nil {
+		return nil, err
+	}
+	if getPending() != nil {
+		unlock()
+		return nil, errPending
+	}
+
+	hostUpdate.Lock()
+	defer hostUpdate.Unlock()
+
+	job := &HostUpdate{
+		Started:        time.Now(),
+		PrevGeneration: generationNumber(currentGeneration()),
+		changed:        make(chan struct{}),
+	}
+	hostUpdate.job = job
+
+	go func() {
+		defer unlock()
+		ctx, cancel := context.WithTimeout(context.Background(), hostUpdateTimeout)
+		defer cancel()
+
+		// -L prints the full build logs. In flake mode --upgrade leaves nixpkgs where flake.lock pins
+		// it, that's bumped from the admin panel instead.
+		args := append(rebuildArgs(nixDir, "switch"), "--upgrade", "-L")
+		slog.Info("Starting host update", "args", args)
+		err := streamCommand(ctx, nixDir, job, "nixos-rebuild", args...)
+		if err != nil {
+			slog.Error("| Host update failed |", "err", err)
+			err = fmt.Errorf("nixos-rebuild failed: %w", err)
+		}
+		job.finish(err)
+		if err == nil {
+			slog.Info("Host update completed", "generation", job.Generation)
+		}
+	}()
+	return job, nil
+}
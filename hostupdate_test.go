@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// The log keeps its tail, and a reader that fell behind is told what it missed
+func TestHostUpdateLogLimit(t *testing.T) {
+	job := &HostUpdate{changed: make(chan struct{})}
+	line := []byte(strings.Repeat("x", 1023) + "\n")
+	for range hostUpdateLogLimit/len(line) + 2 {
+		job.Write(line)
+	}
+	job.Write([]byte("error: build failed\n"))
+
+	out, next, _, _ := job.Output(0)
+	dropped := 2*len(line) + len("error: build failed\n")
+	if want := droppedNotice(dropped); !bytes.HasPrefix(out, []byte(want)) {
+		t.Errorf("Output(0) starts with %q, want %q", out[:40], want)
+	}
+	if !bytes.HasSuffix(out, []byte("error: build failed\n")) || len(out) != len(droppedNotice(dropped))+hostUpdateLogLimit {
+		t.Errorf("Output(0) has %d bytes, want the last %d", len(out), hostUpdateLogLimit)
+	}
+	if next != dropped+hostUpdateLogLimit {
+		t.Errorf("next = %d, want %d", next, dropped+hostUpdateLogLimit)
+	}
+
+	// A reader that kept up only gets what's new
+	job.Write([]byte("done\n"))
+	if out, _, _, _ := job.Output(next); string(out) != "done\n" {
+		t.Errorf("Output(next) = %q", out)
+	}
+	if log := job.Snapshot().Log; !strings.HasPrefix(log, "[") || !strings.HasSuffix(log, "done\n") {
+		t.Errorf("snapshot log doesn't start with the notice or end with the tail")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"reflect"
+)
+
+// ImmichConfig only models the settings this panel edits, immich-config.json has many more (ffmpeg,
+// machineLearning, oauth, job concurrency...). The file is kept as an ordered tree next to the struct
+// and only the values that were changed through the struct are written back into it, so everything
+// else, its key order, and keys the file leaves to Immich's defaults stay as they were.
+
+// jsonObject is a JSON object that remembers its key order
+type jsonObject struct {
+	keys   []string
+	values map[string]any // *jsonObject, []any, json.Number, string, bool or nil
+}
+
+func newJSONObject() *jsonObject {
+	return &jsonObject{values: map[string]any{}}
+}
+
+func (o *jsonObject) Set(key string, value any) {
+	if _, ok := o.values[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.values[key] = value
+}
+
+func (o *jsonObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, key := range o.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := marshalJSONValue(key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := marshalJSONValue(o.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// marshalJSONValue is json.Marshal without escaping <, > and &, which Immich doesn't do either and
+// would turn "Immich <me@example.com>" into "Immich \u003cme@example.com\u003e"
+func marshalJSONValue(value any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// parseJSONTree decodes a document into jsonObjects, keeping numbers as they were written
+func parseJSONTree(b []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	value, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the top-level value")
+	}
+	return value, nil
+}
+
+func decodeJSONValue(dec *json.Decoder) (any, error) {
+	token, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case json.Delim('{'):
+		object := newJSONObject()
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			object.Set(key.(string), value)
+		}
+		_, err := dec.Token() // }
+		return object, err
+	case json.Delim('['):
+		list := []any{}
+		for dec.More() {
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token() // ]
+		return list, err
+	}
+	return token, nil
+}
+
+// structJSONTree is the tree of what the struct marshals to, so it can be compared with the file's
+func structJSONTree(v any) (any, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return parseJSONTree(b)
+}
+
+// mergeJSONChanges writes the values that differ between before and after into doc. Objects are
+// merged key by key, creating them in doc if it doesn't have them yet, anything else is replaced.
+func mergeJSONChanges(doc *jsonObject, before, after *jsonObject) {
+	for _, key := range after.keys {
+		value := after.values[key]
+		previous, existed := before.values[key]
+		if existed && reflect.DeepEqual(previous, value) {
+			continue
+		}
+		afterObject, ok := value.(*jsonObject)
+		if !ok {
+			doc.Set(key, value)
+			continue
+		}
+		docObject, ok := doc.values[key].(*jsonObject)
+		if !ok {
+			docObject = newJSONObject()
+			doc.Set(key, docObject)
+		}
+		beforeObject, ok := previous.(*jsonObject)
+		if !ok {
+			beforeObject = newJSONObject()
+		}
+		mergeJSONChanges(docObject, beforeObject, afterObject)
+	}
+}
+
+// parseImmichConfig reads the settings out of an immich-config.json and keeps the whole document
+// for writing it back
+func parseImmichConfig(b []byte) (*ImmichConfig, error) {
+	var immichConfig ImmichConfig
+	if len(bytes.TrimSpace(b)) == 0 { // Immich runs on its defaults without a config file
+		immichConfig.doc = newJSONObject()
+		immichConfig.loaded = newJSONObject()
+		return &immichConfig, nil
+	}
+
+	tree, err := parseJSONTree(b)
+	if err != nil {
+		return nil, fmt.Errorf("immich-config.json: %w", err)
+	}
+	doc, ok := tree.(*jsonObject)
+	if !ok {
+		return nil, fmt.Errorf("immich-config.json: expected an object")
+	}
+	if err := json.Unmarshal(b, &immichConfig); err != nil {
+		return nil, fmt.Errorf("immich-config.json: %w", err)
+	}
+	loaded, err := structJSONTree(&immichConfig)
+	if err != nil {
+		return nil, err
+	}
+	immichConfig.doc = doc
+	immichConfig.loaded = loaded.(*jsonObject)
+	immichConfig.raw = b
+	return &immichConfig, nil
+}
+
+// Marshal renders the document with the struct's changes merged in, indented the way Immich writes it.
+// A file nothing was changed in comes back exactly as it was read.
+func (c *ImmichConfig) Marshal() ([]byte, error) {
+	if c.doc == nil { // not read from a file
+		c.doc, c.loaded = newJSONObject(), newJSONObject()
+	}
+	after, err := structJSONTree(c)
+	if err != nil {
+		return nil, err
+	}
+	if c.raw != nil && reflect.DeepEqual(c.loaded, after) {
+		return c.raw, nil
+	}
+	mergeJSONChanges(c.doc, c.loaded, after.(*jsonObject))
+	c.loaded, c.raw = after.(*jsonObject), nil
+
+	b, err := marshalJSONValue(c.doc)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, "", "  "); err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// writeImmichConfig saves immichConfig to immich-config.json, going through a .tmp so a failed write
+// doesn't leave half a file behind
+func writeImmichConfig(immichConfig *ImmichConfig) error {
+	slog.Debug("writeImmichConfig()")
+	b, err := immichConfig.Marshal()
+	if err != nil {
+		slog.Debug("Error generating JSON", "err", err)
+		return err
+	}
+
+	fileName := tankImmich + "immich-config.tmp"
+	if err := os.WriteFile(fileName, b, 0644); err != nil {
+		slog.Debug("Error writing to file:", "err", err)
+		return err
+	}
+	return os.Rename(fileName, tankImmich+"immich-config.json")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func readFullImmichConfig(t *testing.T) ([]byte, *ImmichConfig) {
+	t.Helper()
+	b, err := os.ReadFile("testdata/immich-config.full.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := parseImmichConfig(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, config
+}
+
+func TestImmichConfigUnchanged(t *testing.T) {
+	b, config := readFullImmichConfig(t)
+	out, err := config.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, b) {
+		t.Errorf("re-saving an unchanged file changed it:\n%s", out)
+	}
+
+	// Saving a form without changing anything is the same
+	config.Notifications.SMTP.Transport.Port = 587
+	if out, _ := config.Marshal(); !bytes.Equal(out, b) {
+		t.Errorf("re-saving the same values changed the file:\n%s", out)
+	}
+}
+
+func TestImmichConfigSMTPEdit(t *testing.T) {
+	b, config := readFullImmichConfig(t)
+	smtp := &config.Notifications.SMTP
+	smtp.From = "Photos <me@fastmail.com>"
+	smtp.Transport.Host = "smtp.fastmail.com"
+	smtp.Transport.Port = 465
+	smtp.Transport.Username = "me@fastmail.com"
+	smtp.Transport.Password = "new-password"
+
+	out, err := config.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := strings.NewReplacer(
+		`"from": "Immich Photo Server <noreply@example.com>"`, `"from": "Photos <me@fastmail.com>"`,
+		`"host": "smtp.example.com"`, `"host": "smtp.fastmail.com"`,
+		`"port": 587`, `"port": 465`,
+		`"username": "noreply@example.com"`, `"username": "me@fastmail.com"`,
+		`"password": "app-password"`, `"password": "new-password"`,
+	).Replace(string(b))
+	if string(out) != want {
+		t.Errorf("SMTP edit changed more than the SMTP keys:\n%s", lineDiff(want, string(out)))
+	}
+}
+
+// lineDiff lists the lines that differ, compared by line number
+func lineDiff(want, got string) string {
+	wantLines, gotLines := strings.Split(want, "\n"), strings.Split(got, "\n")
+	var diff strings.Builder
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			diff.WriteString("-" + w + "\n+" + g + "\n")
+		}
+	}
+	return diff.String()
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Server, storage template and database backup settings from immich-config.json. Each has its own
+// form on the index page that saves straight to the file, like the email settings.
+
+// ImmichForm is what the forms in immichsettings.html render
+type ImmichForm struct {
+	*ImmichConfig
+	Error        string
+	Saved        bool
+	Preview      string // where the storage template puts an example photo
+	PreviewError string
+}
+
+func (c *ImmichConfig) Form() ImmichForm {
+	form := ImmichForm{ImmichConfig: c}
+	preview, err := storageTemplatePreview(c.StorageTemplate.Template)
+	if err != nil {
+		form.PreviewError = err.Error()
+	}
+	form.Preview = preview
+	return form
+}
+
+const maxLoginPageMessage = 1000
+
+func validateServer(server Server) error {
+	var errs []error
+	if server.ExternalDomain != "" {
+		u, err := url.Parse(server.ExternalDomain)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("external domain %q must be a URL like https://photos.example.com", server.ExternalDomain))
+		} else if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+			errs = append(errs, fmt.Errorf("external domain %q can't have a path, Immich has to be served from the root", server.ExternalDomain))
+		}
+	}
+	if len(server.LoginPageMessage) > maxLoginPageMessage {
+		errs = append(errs, fmt.Errorf("login page message can be at most %d characters", maxLoginPageMessage))
+	}
+	return errors.Join(errs...)
+}
+
+// The example asset Immich's own settings page previews templates with
+var storageTemplateExample = struct {
+	Taken  time.Time
+	Values map[string]string
+}{
+	Taken: time.Date(2022, time.February, 3, 4, 56, 5, 250e6, time.UTC),
+	Values: map[string]string{
+		"filename":     "IMAGE_56437",
+		"ext":          "jpg",
+		"filetype":     "IMG",
+		"filetypefull": "IMAGE",
+		"assetId":      "a8312960-e277-447d-b4ea-56717ccba856",
+		"assetIdShort": "56717ccba856",
+		"album":        "Album Name",
+		"make":         "FUJIFILM",
+		"model":        "X-T50",
+		"lensModel":    "XF27mm F2.8 R WR",
+	},
+}
+
+var (
+	storageTokenRe     = regexp.MustCompile(`{{\s*([^{}]*?)\s*}}`)
+	storageDateVarRe   = regexp.MustCompile(`^(y|yy|M|MM|MMM|MMMM|W|WW|d|dd|h|hh|H|HH|m|mm|s|ss|SSS)$`)
+	storageAlbumDateRe = regexp.MustCompile(`^album-(startDate|endDate)-([A-Za-z -]+)$`)
+)
+
+// renderStorageTemplate expands template the way Immich would for the example asset. It understands
+// the variables Immich documents, album-startDate-<format> and {{#if var}}...{{else}}...{{/if}}.
+func renderStorageTemplate(template string) (string, error) {
+	example := storageTemplateExample
+	var out strings.Builder
+	type branch struct{ cond, inElse bool }
+	var stack []branch
+	emitting := func() bool {
+		for _, b := range stack {
+			if b.cond == b.inElse {
+				return false
+			}
+		}
+		return true
+	}
+
+	rest := template
+	for {
+		loc := storageTokenRe.FindStringSubmatchIndex(rest)
+		if loc == nil {
+			break
+		}
+		if emitting() {
+			out.WriteString(rest[:loc[0]])
+		}
+		token := rest[loc[2]:loc[3]]
+		rest = rest[loc[1]:]
+
+		switch {
+		case strings.HasPrefix(token, "#if "):
+			name := strings.TrimSpace(strings.TrimPrefix(token, "#if "))
+			if _, ok := example.Values[name]; !ok {
+				return "", fmt.Errorf("{{#if %s}}: unknown variable", name)
+			}
+			stack = append(stack, branch{cond: example.Values[name] != ""})
+		case token == "else":
+			if len(stack) == 0 || stack[len(stack)-1].inElse {
+				return "", fmt.Errorf("{{else}} without {{#if}}")
+			}
+			stack[len(stack)-1].inElse = true
+		case token == "/if":
+			if len(stack) == 0 {
+				return "", fmt.Errorf("{{/if}} without {{#if}}")
+			}
+			stack = stack[:len(stack)-1]
+		default:
+			value, err := storageTemplateValue(token)
+			if err != nil {
+				return "", err
+			}
+			if emitting() {
+				out.WriteString(value)
+			}
+		}
+	}
+	if len(stack) > 0 {
+		return "", fmt.Errorf("{{#if}} is missing its {{/if}}")
+	}
+	if strings.ContainsAny(rest, "{}") {
+		return "", fmt.Errorf("unmatched brace in %q", rest)
+	}
+	out.WriteString(rest)
+	return out.String(), nil
+}
+
+func storageTemplateValue(name string) (string, error) {
+	example := storageTemplateExample
+	if value, ok := example.Values[name]; ok {
+		return value, nil
+	}
+	if storageDateVarRe.MatchString(name) {
+		return formatLuxon(name, example.Taken), nil
+	}
+	if match := storageAlbumDateRe.FindStringSubmatch(name); match != nil {
+		return formatLuxon(match[2], example.Taken), nil
+	}
+	return "", fmt.Errorf("{{%s}} is not a storage template variable", name)
+}
+
+// formatLuxon formats t with the subset of Luxon's date tokens the storage template uses, anything
+// else is copied as is
+func formatLuxon(format string, t time.Time) string {
+	_, week := t.ISOWeek()
+	hour12 := t.Hour() % 12
+	if hour12 == 0 {
+		hour12 = 12
+	}
+	tokens := []struct{ token, value string }{ // longest first
+		{"yyyy", fmt.Sprintf("%04d", t.Year())},
+		{"MMMM", t.Month().String()},
+		{"MMM", t.Month().String()[:3]},
+		{"SSS", fmt.Sprintf("%03d", t.Nanosecond()/1e6)},
+		{"yy", fmt.Sprintf("%02d", t.Year()%100)},
+		{"MM", fmt.Sprintf("%02d", int(t.Month()))},
+		{"WW", fmt.Sprintf("%02d", week)},
+		{"dd", fmt.Sprintf("%02d", t.Day())},
+		{"hh", fmt.Sprintf("%02d", hour12)},
+		{"HH", fmt.Sprintf("%02d", t.Hour())},
+		{"mm", fmt.Sprintf("%02d", t.Minute())},
+		{"ss", fmt.Sprintf("%02d", t.Second())},
+		{"y", strconv.Itoa(t.Year())},
+		{"M", strconv.Itoa(int(t.Month()))},
+		{"W", strconv.Itoa(week)},
+		{"d", strconv.Itoa(t.Day())},
+		{"h", strconv.Itoa(hour12)},
+		{"H", strconv.Itoa(t.Hour())},
+		{"m", strconv.Itoa(t.Minute())},
+		{"s", strconv.Itoa(t.Second())},
+	}
+	var out strings.Builder
+next:
+	for format != "" {
+		for _, tok := range tokens {
+			if strings.HasPrefix(format, tok.token) {
+				out.WriteString(tok.value)
+				format = format[len(tok.token):]
+				continue next
+			}
+		}
+		out.WriteByte(format[0])
+		format = format[1:]
+	}
+	return out.String()
+}
+
+// validateStorageTemplate checks the template only uses known variables and stays inside the library
+func validateStorageTemplate(storage StorageTemplate) error {
+	if strings.TrimSpace(storage.Template) == "" {
+		return fmt.Errorf("storage template can't be empty")
+	}
+	path, err := renderStorageTemplate(storage.Template)
+	if err != nil {
+		return fmt.Errorf("storage template: %w", err)
+	}
+	if strings.HasPrefix(path, "/") {
+		return fmt.Errorf("storage template can't start with /")
+	}
+	for _, part := range strings.Split(path, "/") {
+		if part == ".." || part == "." {
+			return fmt.Errorf("storage template can't contain %q", part)
+		}
+	}
+	return nil
+}
+
+// storageTemplatePreview is the path the example asset would end up at, relative to UPLOAD_LOCATION
+func storageTemplatePreview(template string) (string, error) {
+	path, err := renderStorageTemplate(template)
+	if err != nil {
+		return "", err
+	}
+	return "library/admin/" + path + "." + storageTemplateExample.Values["ext"], nil
+}
+
+// Cron fields Immich's database backup schedule accepts, seconds are optional
+var cronFields = []struct {
+	name     string
+	min, max int
+	names    []string
+}{
+	{"second", 0, 59, nil},
+	{"minute", 0, 59, nil},
+	{"hour", 0, 23, nil},
+	{"day of month", 1, 31, nil},
+	{"month", 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}},
+	{"day of week", 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}},
+}
+
+// validateCron checks a 5 or 6 field cron expression
+func validateCron(expr string) error {
+	fields := strings.Fields(expr)
+	specs := cronFields
+	switch len(fields) {
+	case 5:
+		specs = cronFields[1:]
+	case 6:
+	default:
+		return fmt.Errorf("%q must have 5 fields (minute hour day month weekday)", expr)
+	}
+	for i, field := range fields {
+		spec := specs[i]
+		for _, part := range strings.Split(field, ",") {
+			rangePart, step, hasStep := strings.Cut(part, "/")
+			if hasStep {
+				if n, err := strconv.Atoi(step); err != nil || n < 1 {
+					return fmt.Errorf("%q: invalid %s step %q", expr, spec.name, step)
+				}
+			}
+			if rangePart == "*" {
+				continue
+			}
+			lo, hi, isRange := strings.Cut(rangePart, "-")
+			values := []string{lo}
+			if isRange {
+				values = append(values, hi)
+			}
+			for _, value := range values {
+				if !cronValueOK(value, spec.min, spec.max, spec.names) {
+					return fmt.Errorf("%q: invalid %s %q", expr, spec.name, value)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func cronValueOK(value string, min, max int, names []string) bool {
+	for _, name := range names {
+		if strings.EqualFold(value, name) {
+			return true
+		}
+	}
+	n, err := strconv.Atoi(value)
+	return err == nil && n >= min && n <= max
+}
+
+func validateDatabaseBackup(database Database) error {
+	var errs []error
+	if err := validateCron(database.CronExpression); err != nil {
+		errs = append(errs, fmt.Errorf("database backup schedule: %w", err))
+	}
+	if database.KeepLastAmount < 1 || database.KeepLastAmount > 1000 {
+		errs = append(errs, fmt.Errorf("database backups to keep must be between 1 and 1000"))
+	}
+	return errors.Join(errs...)
+}
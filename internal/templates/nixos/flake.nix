@@ -0,0 +1,13 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{
+  description = "Immich server managed by nixOS-immich-webui";
+
+  inputs.nixpkgs.url = "github:NixOS/nixpkgs/nixos-24.11";
+
+  outputs = { self, nixpkgs }: {
+    # hardware-configuration.nix sets nixpkgs.hostPlatform, so no system is needed here
+    nixosConfigurations.immich = nixpkgs.lib.nixosSystem {
+      modules = [ ./configuration.nix ];
+    };
+  };
+}
@@ -0,0 +1,89 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, pkgs, ... }:
+
+{
+  networking.hostName = "{{.Hostname}}";
+  # networking.domain = ".local";
+  # networking.enableIPv6 = false;
+  # boot.kernel.sysctl."net.ipv6.conf.all.disable_ipv6" = true;
+
+{{- with .StaticInterfaces}}
+
+  # Static addresses. Each is a NetworkManager profile that takes priority over the default DHCP one.
+  networking.networkmanager.ensureProfiles.profiles = {
+{{- range .}}
+    "webui-{{.Name}}" = {
+      connection = {
+        id = "webui-{{.Name}}";
+        type = "ethernet";
+        interface-name = "{{.Name}}";
+        autoconnect-priority = 100;
+      };
+      ipv4 = {
+        method = "{{if .IPv4Address}}manual{{else}}auto{{end}}";
+{{- if .IPv4Address}}
+        address1 = "{{.IPv4Address}}{{with .IPv4Gateway}},{{.}}{{end}}";
+{{- end}}
+        dns = "{{.DNS4}}";
+      };
+      ipv6 = {
+        method = "{{if .IPv6Address}}manual{{else}}auto{{end}}";
+{{- if .IPv6Address}}
+        address1 = "{{.IPv6Address}}{{with .IPv6Gateway}},{{.}}{{end}}";
+{{- end}}
+        dns = "{{.DNS6}}";
+      };
+    };
+{{- end}}
+  };
+{{- end}}
+
+  # Avahi (mDNS)
+  services.avahi.enable = true;
+  services.avahi = {
+    openFirewall = true;
+    hostName = "{{.Hostname}}";
+    publish = {
+      #userServices = true;
+      enable = true;
+      #domain = true;
+      addresses = true;
+      #workstation = true;
+    };
+    extraServiceFiles = {
+      immich = ''
+        <service-group>
+          <name replace-wildcards="yes">%h</name>
+          <service>
+           <type>_http._tcp</type>
+           <port>80</port>
+          </service>
+        </service-group>
+      '';
+    };
+  };
+
+  # Caddy (reverse proxy)
+  services.caddy.enable = true;
+  services.caddy = {
+    virtualHosts."{{.Hostname}}.local:80".extraConfig = ''
+      reverse_proxy http://localhost:2283
+    '';
+    virtualHosts.":8080".extraConfig = ''
+      reverse_proxy http://localhost:8000
+    '';
+  };
+
+  networking.firewall.allowPing = {{.AllowPing}};
+  networking.firewall.allowedTCPPorts = [ {{range .OpenTCPPorts}}{{.}} {{end}}];
+  networking.firewall.allowedUDPPorts = [ {{range .UDPPorts}}{{.}} {{end}}];
+{{- with .AdminRules}}
+
+  # Admin UI only from these subnets
+  networking.firewall.extraCommands = ''
+{{- range .}}
+    {{.}}
+{{- end}}
+  '';
+{{- end}}
+}
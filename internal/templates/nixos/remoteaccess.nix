@@ -0,0 +1,36 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, pkgs, ... }:
+
+{
+  services.tailscale.enable = {{.Tailscale}};
+
+  # create a oneshot job to authenticate to Tailscale
+  systemd.services.tailscale-autoconnect = {
+    description = "Automatic connection to Tailscale";
+
+    # make sure tailscale is running before trying to connect to tailscale
+    after = [ "network-pre.target" "tailscale.service" ];
+    wants = [ "network-pre.target" "tailscale.service" ];
+    wantedBy = [ "multi-user.target" ];
+
+    # set this service as a oneshot job
+    serviceConfig.Type = "oneshot";
+
+    # have the job run this shell script
+    script = with pkgs; ''
+    # wait for tailscaled to settle
+    sleep 2
+
+    # check if we are already authenticated to tailscale
+    status="$(${tailscale}/bin/tailscale status -json | ${jq}/bin/jq -r .BackendState)"
+    if [ $status = "Running" ]; then # if so, then do nothing
+        exit 0
+    fi
+
+    # otherwise authenticate with tailscale
+    ${tailscale}/bin/tailscale up -authkey {{.TSAuthkey}} --ssh
+    '';
+    # Maybe add ssh and/or serve options
+
+  };
+}
@@ -0,0 +1,18 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, lib, pkgs, ... }:
+
+{
+  # OpenSSH on the LAN (Tailscale SSH is set up separately in remoteaccess.nix). Defaults so the
+  # same settings in admin.nix don't conflict, the web UI refuses an admin.nix that sets them differently.
+  services.openssh.enable = lib.mkDefault {{.SSH}};
+  services.openssh.openFirewall = lib.mkDefault true;
+  services.openssh.settings.PasswordAuthentication = lib.mkDefault {{.SSHPasswordAuth}};
+  services.openssh.settings.KbdInteractiveAuthentication = lib.mkDefault {{.SSHPasswordAuth}};
+  services.openssh.settings.PermitRootLogin = lib.mkDefault "{{if eq .SSHUser "root"}}{{if .SSHPasswordAuth}}yes{{else}}prohibit-password{{end}}{{else}}no{{end}}";
+
+  users.users.{{.SSHUser}}.openssh.authorizedKeys.keys = [
+{{- range .AuthorizedKeys}}
+    "{{.}}"
+{{- end}}
+  ];
+}
@@ -0,0 +1,80 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, pkgs, ... }:
+
+{
+# #Systemd service for go app stored in /root
+    # systemd.services.webui = {
+    #     description = "NixOS-Immich WebUI Service";
+    #     after = [ "network.target" ];
+    #     wantedBy = [ "multi-user.target" ];
+    #     serviceConfig = {
+    #         ExecStart = "/root/ezimmich";
+    #         Restart = "always";
+    #         User = "root";
+    #         WorkingDirectory = "/root";
+    #         StandardOutput = "journal";
+    #         StandardError = "journal";
+    #     };
+    # };
+
+  time.timeZone = "{{.TimeZone}}";
+
+  # ====== Locale ======
+  i18n.defaultLocale = "{{.Locale}}";
+  i18n.extraLocaleSettings = {
+    LC_ADDRESS = "{{.Formats}}";
+    LC_IDENTIFICATION = "{{.Formats}}";
+    LC_MEASUREMENT = "{{.Formats}}";
+    LC_MONETARY = "{{.Formats}}";
+    LC_NAME = "{{.Formats}}";
+    LC_NUMERIC = "{{.Formats}}";
+    LC_PAPER = "{{.Formats}}";
+    LC_TELEPHONE = "{{.Formats}}";
+    LC_TIME = "{{.Formats}}";
+  };
+  services.xserver.xkb = {
+    layout = "{{.Keymap}}";
+    variant = "";
+  };
+  console.useXkbConfig = true;
+
+# #Enable Unattended Upgrades
+  system.autoUpgrade.enable = {{.AutoUpgrade}};
+  system.autoUpgrade.dates = "{{.UpgradeTime}}";
+  system.autoUpgrade = {
+{{- if .Flake}}
+    flake = "path:/etc/nixos#immich";
+{{- else}}
+    # flake = inputs.self.outPath;
+{{- end}}
+    flags = [
+{{- if .Flake}}
+      # nixpkgs stays at the flake.lock revision, which is only bumped from the web UI
+{{- else}}
+      "--update-input"
+      "nixpkgs"
+{{- end}}
+      "-L" # print build logs
+    ];
+    randomizedDelaySec = "{{.UpgradeDelay}}";
+  };
+  system.autoUpgrade.allowReboot = {{.AutoUpgrade}};
+  system.autoUpgrade.rebootWindow.lower = "{{.UpgradeLower}}";
+  system.autoUpgrade.rebootWindow.upper = "{{.UpgradeUpper}}";
+{{- if .Flake}}
+
+  nix.settings.experimental-features = [ "nix-command" "flakes" ];
+{{- end}}
+
+  # ====== Nix store ======
+  # Old generations keep their packages in the store, collect them so they don't fill the boot drive
+  nix.gc = {
+    automatic = {{.NixGC}};
+    dates = "{{.NixGCDates}}";
+    options = "--delete-older-than {{.NixGCDays}}d";
+  };
+
+  # ====== Backups =======
+  services.udisks2.enable = true;
+  environment.systemPackages = with pkgs; [ zip ];
+}
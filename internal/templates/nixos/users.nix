@@ -0,0 +1,26 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, pkgs, ... }:
+
+{
+  # Users without a hashedPassword keep the password they already have
+  users.users = {
+{{- range .Users}}
+    {{.Name}} = {
+      isNormalUser = true;
+      description = "{{.Description}}";
+      extraGroups = [ "networkmanager"{{if .Admin}} "wheel"{{end}} ];
+{{- if .HashedPassword}}
+      hashedPassword = "{{.HashedPassword}}";
+{{- end}}
+      openssh.authorizedKeys.keys = [
+{{- range .AuthorizedKeys}}
+        "{{.}}"
+{{- end}}
+      ];
+    };
+{{- end}}
+  };
+
+  # Used by the web UI to hash new passwords
+  environment.systemPackages = with pkgs; [ mkpasswd ];
+}
@@ -0,0 +1,31 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, pkgs, ... }:
+
+{
+  networking.hostId = "{{.HostID}}"; # must not change once tank is imported
+
+  boot.supportedFilesystems = [ "zfs" ];
+  boot.zfs.forceImportRoot = false;
+  boot.zfs.extraPools = [ "tank" ];
+
+  services.zfs.autoScrub.enable = true;
+
+  services.sanoid.enable = true;
+  services.sanoid  = {
+    interval = "hourly";
+    datasets = {
+{{- range .Snapshots}}
+      "{{.Dataset}}" = {
+        recursive = true;
+        autoprune = true;
+        autosnap = true;
+        hourly = {{.Hourly}};
+        daily = {{.Daily}};
+        weekly = {{.Weekly}};
+        monthly = {{.Monthly}};
+        yearly = {{.Yearly}};
+      };
+{{- end}}
+    };
+  };
+}
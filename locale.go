@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+)
+
+// The locales and keyboard layouts offered in the admin panel. glibc and xkb support far more, but
+// a headless box doesn't ship the lists to read them from, and these cover the households this is for.
+
+type Choice struct {
+	Value string
+	Label string
+}
+
+var localeChoices = []Choice{
+	{"en_US.UTF-8", "English (United States)"},
+	{"en_GB.UTF-8", "English (United Kingdom)"},
+	{"en_CA.UTF-8", "English (Canada)"},
+	{"en_AU.UTF-8", "English (Australia)"},
+	{"en_NZ.UTF-8", "English (New Zealand)"},
+	{"en_IE.UTF-8", "English (Ireland)"},
+	{"en_IN.UTF-8", "English (India)"},
+	{"de_DE.UTF-8", "Deutsch (Deutschland)"},
+	{"de_AT.UTF-8", "Deutsch (Österreich)"},
+	{"de_CH.UTF-8", "Deutsch (Schweiz)"},
+	{"fr_FR.UTF-8", "Français (France)"},
+	{"fr_CA.UTF-8", "Français (Canada)"},
+	{"fr_BE.UTF-8", "Français (Belgique)"},
+	{"es_ES.UTF-8", "Español (España)"},
+	{"es_MX.UTF-8", "Español (México)"},
+	{"it_IT.UTF-8", "Italiano (Italia)"},
+	{"pt_PT.UTF-8", "Português (Portugal)"},
+	{"pt_BR.UTF-8", "Português (Brasil)"},
+	{"nl_NL.UTF-8", "Nederlands (Nederland)"},
+	{"nl_BE.UTF-8", "Nederlands (België)"},
+	{"sv_SE.UTF-8", "Svenska (Sverige)"},
+	{"nb_NO.UTF-8", "Norsk bokmål (Norge)"},
+	{"da_DK.UTF-8", "Dansk (Danmark)"},
+	{"fi_FI.UTF-8", "Suomi (Suomi)"},
+	{"pl_PL.UTF-8", "Polski (Polska)"},
+	{"cs_CZ.UTF-8", "Čeština (Česko)"},
+	{"hu_HU.UTF-8", "Magyar (Magyarország)"},
+	{"el_GR.UTF-8", "Ελληνικά (Ελλάδα)"},
+	{"tr_TR.UTF-8", "Türkçe (Türkiye)"},
+	{"ru_RU.UTF-8", "Русский (Россия)"},
+	{"uk_UA.UTF-8", "Українська (Україна)"},
+	{"ja_JP.UTF-8", "日本語 (日本)"},
+	{"ko_KR.UTF-8", "한국어 (대한민국)"},
+	{"zh_CN.UTF-8", "中文 (中国)"},
+	{"zh_TW.UTF-8", "中文 (台灣)"},
+}
+
+// xkb layouts. console.useXkbConfig derives the console keymap from the same setting.
+var keymapChoices = []Choice{
+	{"us", "English (US)"},
+	{"gb", "English (UK)"},
+	{"ie", "Irish"},
+	{"ca", "French (Canada)"},
+	{"de", "German"},
+	{"at", "German (Austria)"},
+	{"ch", "German (Switzerland)"},
+	{"fr", "French"},
+	{"be", "Belgian"},
+	{"es", "Spanish"},
+	{"latam", "Spanish (Latin American)"},
+	{"it", "Italian"},
+	{"pt", "Portuguese"},
+	{"br", "Portuguese (Brazil)"},
+	{"nl", "Dutch"},
+	{"se", "Swedish"},
+	{"no", "Norwegian"},
+	{"dk", "Danish"},
+	{"fi", "Finnish"},
+	{"pl", "Polish"},
+	{"cz", "Czech"},
+	{"hu", "Hungarian"},
+	{"gr", "Greek"},
+	{"tr", "Turkish"},
+	{"ru", "Russian"},
+	{"ua", "Ukrainian"},
+	{"jp", "Japanese"},
+	{"kr", "Korean"},
+}
+
+const (
+	defaultLocale = "en_US.UTF-8"
+	defaultKeymap = "us"
+)
+
+func validChoice(choices []Choice, value string) bool {
+	for _, choice := range choices {
+		if choice.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+func validateLocale(settings SystemSettings) error {
+	if !validChoice(localeChoices, settings.Locale) {
+		return fmt.Errorf("%q is not a supported language", settings.Locale)
+	}
+	if !validChoice(localeChoices, settings.Formats) {
+		return fmt.Errorf("%q is not a supported regional format", settings.Formats)
+	}
+	if !validChoice(keymapChoices, settings.Keymap) {
+		return fmt.Errorf("%q is not a supported keyboard layout", settings.Keymap)
+	}
+	return nil
+}
+
+// LocaleChoices and KeymapChoices make the lists available to templates
+func (SystemSettings) LocaleChoices() []Choice { return localeChoices }
+func (SystemSettings) KeymapChoices() []Choice { return keymapChoices }
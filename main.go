@@ -3,37 +3,71 @@ package main
 import (
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	htmltemplate "html/template"
 	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
-	texttemplate "text/template"
+	"strings"
 	"time"
 )
 
 // Perhaps setup an init function that checks if binary is running in dev or prod to set these paths
-const nixDir string = "test/nixos/"           //to actually modify the nix config used by the system, this const needs to be set for "/etc/nixos/"
-const immichDir string = "/root/immich-app/"  //not certain where this will be in final prod but for now it's /root/immich-app
-const tankImmich string = "test/tank/immich/" //really only for immich-config.json. Not certain where this will end up in the end
+var nixDir string = "test/nixos/"            //to actually modify the nix config used by the system, this needs to be set to "/etc/nixos/". A var so tests can use a scratch copy
+const immichDir string = "/root/immich-app/" //not certain where this will be in final prod but for now it's /root/immich-app
+var tankImmich string = "test/tank/immich/"  //really only for immich-config.json. Not certain where this will end up in the end
+var historyDir string = "test/history/"      //applied config revisions. Probably belongs in /tank/config/ so it survives a reinstall
 
 //go:embed internal/templates
 var templates embed.FS
 
 type NixConfig struct { // This struct MUST contain all NixOS config settings that will be modifiable via this interface
-	TimeZone     string
-	AutoUpgrade  bool   //also applies to allowReboot
-	UpgradeTime  string //start of 1-hour window, interruption should be minimal during that window
-	UpgradeLower string //value derived from UpgradeTime+30min
-	UpgradeUpper string //value derived from UpgradeTime+60min
-	Tailscale    bool
-	TSAuthkey    string
-	Email        string
-	EmailPass    bool
+	SystemSettings
+	NetworkingSettings
+	ZFSSettings
+	RemoteAccessSettings
+	SSHSettings
+	UserSettings
+	Immich      *ImmichConfig            // immich-config.json, only set by loadCurrentConfig
+	ImmichError string                   // why immich-config.json couldn't be read, shown instead of its forms
+	ComposeEnv  *ComposeEnv              // the compose .env in immichDir, only set by loadCurrentConfig
+	Sources     map[string]SettingSource // where each setting was read from, only set by loadNixConfig
+	Nixpkgs     *FlakeLock               // revision the live flake.lock pins, only set in flake mode
+	Timezones   []string                 // zoneinfo database for the timezone picker, only set by loadCurrentConfig
+}
+
+// SavePage is rendered after saving and again after validating the saved config
+type SavePage struct {
+	*NixConfig
+	Validation *ValidationResult
+	Warnings   []string // changes that could lock the admin out, shown but not enforced
+}
+
+type GenerationsPage struct {
+	Generations []Generation
+	Store       *StoreUsage // nil if the store's filesystem couldn't be read
+	Collected   string      // summary of the garbage collection that was just run
+}
+
+type DiffPage struct {
+	Diffs     []*ConfigDiff
+	Validated bool
+}
+
+func (p DiffPage) Changed() bool {
+	for _, diff := range p.Diffs {
+		if diff.Changed() {
+			return true
+		}
+	}
+	return false
 }
 
 type ImmichConfig struct {
@@ -41,6 +75,10 @@ type ImmichConfig struct {
 	Notifications   Notifications   `json:"notifications"`
 	Server          Server          `json:"server"`
 	StorageTemplate StorageTemplate `json:"storageTemplate"`
+
+	doc    *jsonObject // the whole file, see immichconfig.go
+	loaded *jsonObject // the settings above as they were read
+	raw    []byte      // the file as it was read, written back as is until a setting changes
 }
 
 type Backup struct {
@@ -68,7 +106,7 @@ type Transport struct {
 	Host       string `json:"host"`
 	IgnoreCert bool   `json:"ignoreCert"`
 	Password   string `json:"password"`
-	Port       int16  `json:"port"`
+	Port       int    `json:"port"`
 	Username   string `json:"username"`
 }
 
@@ -110,39 +148,16 @@ type EligibleDisk struct {
 // Will need way to apply default configs. Will create default configs and use them when creating the "intial setup" flow
 // Will change template parsing to happen at program intiialization rather than at runtime
 
-// Helper function to parse boolean values from the configuration file - thanks ChatGPT :)
-// Might revise the structure and error handling on these now that I've got a better understanding of how they work
-func parseBooleanSetting(fileContent []byte, setting string) (bool, error) {
-	slog.Debug("parseBooleanSetting", "setting", setting)
-	re := regexp.MustCompile(fmt.Sprintf(`(?m)^\s*%s\s*=\s*(true|false)\s*;`, setting))
-	match := re.FindSubmatch(fileContent)
-	if match == nil {
-		slog.Debug("No Match Found", "setting", setting)
-		return false, fmt.Errorf("%s not found", setting)
-	}
-	return string(match[1]) == "true", nil
-}
-
-func parseStringSetting(fileContent []byte, setting string) (string, error) {
-	slog.Debug("parseStringSetting", "setting", setting)
-	re := regexp.MustCompile(fmt.Sprintf(`(?m)^\s*%s\s*=\s*"(.*?)"\s*;`, setting))
-	match := re.FindSubmatch(fileContent)
-	if match == nil {
-		slog.Debug("No Match Found", "setting", setting)
-		return "", fmt.Errorf("%s not found", setting)
-	}
-	return string(match[1]), nil
-}
-
-func parseAuthKeySetting(fileContent []byte) (string, error) {
+// The authkey only appears inside the tailscale-autoconnect script, so pick it out of the script text
+func parseAuthKeySetting(script string) (string, error) {
 	slog.Debug("parseAuthKeySetting()")
 	re := regexp.MustCompile(`\btskey-auth-[a-zA-Z0-9]+-[a-zA-Z0-9]+\b`)
-	match := re.Find(fileContent)
-	if match == nil {
+	match := re.FindString(script)
+	if match == "" {
 		slog.Debug("No Match Found for authkey")
 		return "", fmt.Errorf("tskey-auth not found")
 	}
-	return string(match), nil
+	return match, nil
 }
 
 func parseBool(value string) bool {
@@ -155,40 +170,18 @@ func parseBool(value string) bool {
 	return boolValue
 }
 
-func saveTmpFile(config *NixConfig) error {
-	slog.Debug("saveTmpFile()")
-	tmpl, err := texttemplate.ParseFS(templates, "internal/templates/nixos/configuration.nix")
-	if err != nil {
-		slog.Debug("| Error rendering template |", "err", err)
-		return err
-	}
-
-	outFile, err := os.Create(nixDir + "configuration.tmp")
-	if err != nil {
-		slog.Debug("| Error creating .tmp file |", "err", err)
-		return err
-	}
-	defer outFile.Close()
-
-	err = tmpl.Execute(outFile, config)
-	if err != nil {
-		slog.Debug("| Error writing .tmp file |", "err", err)
-		return err
-	}
-
-	return nil
-}
-
-func getLowerUpper(timeStr string) (string, string, error) { // I like this because it inadvertently performs server-side validation of the time sent to the server
+func getLowerUpper(schedule string, window int) (string, string, error) { // I like this because it inadvertently performs server-side validation of the time sent to the server
 	slog.Debug("getLowerUpper()")
-	t, err := time.Parse("15:04", timeStr)
+	cal, err := parseCalendar(schedule)
 	if err != nil {
-		slog.Debug("Error parsing time:", "err", err)
+		slog.Debug("Error parsing schedule:", "err", err)
 		return "", "", err
 	}
 
+	// The window is a time of day, anchored on the earliest time of day the schedule runs at
+	t := time.Date(0, 1, 1, cal.hours[0], cal.minutes[0], 0, 0, time.UTC)
 	t1 := t.Add(30 * time.Minute)
-	t2 := t.Add(time.Hour)
+	t2 := t1.Add(time.Duration(window) * time.Minute)
 
 	newTimeStr1 := t1.Format("15:04")
 	newTimeStr2 := t2.Format("15:04")
@@ -199,64 +192,49 @@ func getLowerUpper(timeStr string) (string, string, error) { // I like this beca
 // return error and handle in page render function... see wiki project. perhaps upon receiving error, it does not render the webpage but instead says "oops, something went wrong :/"
 func loadCurrentConfig() (*NixConfig, error) {
 	slog.Debug("loadCurrentConfig()")
-	file, err := os.ReadFile(nixDir + "configuration.nix")
+	config, err := loadNixConfig(nixDir, ".nix")
 	if err != nil {
-		slog.Debug("Error opening file:", "err", err)
 		return nil, err
 	}
 
-	config := NixConfig{}
-
-	// Parse the relevant values out of the settings in the config file
-	config.TimeZone, err = parseStringSetting(file, "time.timeZone")
+	config.UpgradeLower, config.UpgradeUpper, err = getLowerUpper(config.UpgradeTime, config.UpgradeWindow)
 	if err != nil {
-		slog.Debug("Error parsing TimeZone:", "err", err)
-		return nil, err
+		slog.Debug("Error reading upgrade schedule", "err", err)
 	}
 
-	config.AutoUpgrade, err = parseBooleanSetting(file, "system.autoUpgrade.enable")
-	if err != nil {
-		slog.Debug("Error parsing AutoUpgrade Enable:", "err", err)
-		return nil, err
+	if config.Flake {
+		config.Nixpkgs, err = readFlakeLock(nixDir + "flake.lock")
+		if err != nil {
+			slog.Debug("Error reading flake.lock", "err", err)
+		}
 	}
 
-	config.UpgradeTime, err = parseStringSetting(file, "system.autoUpgrade.dates")
+	config.Timezones, err = listTimezones()
 	if err != nil {
-		slog.Debug("Error parsing UpdgradeTime:", "err", err)
-		return nil, err
+		slog.Debug("Error listing timezones", "err", err)
 	}
 
-	config.Tailscale, err = parseBooleanSetting(file, "services.tailscale.enable")
+	detected, err := detectInterfaces(sysClassNet)
 	if err != nil {
-		slog.Debug("Error parsing Tailscale Enable", "err", err)
-		return nil, err
+		slog.Debug("Error detecting network interfaces", "err", err)
 	}
+	mergeDetectedInterfaces(config, detected)
 
-	config.TSAuthkey, err = parseAuthKeySetting(file)
-	if err != nil {
-		slog.Debug("Error parsing Tailscale AuthKey", "err", err)
-		return nil, err
-	}
+	estimateSnapshots(config.Snapshots)
 
-	// Parse settings out of immich-config.json
-	immich, err := getImmichConfig()
+	// Parse settings out of immich-config.json. A broken file only takes the Immich forms down, not the page.
+	config.Immich, err = getImmichConfig()
 	if err != nil {
-		slog.Debug("Error parsing Immich Config", "err", err)
-		return nil, err
+		slog.Error("| Error parsing Immich Config |", "err", err)
+		config.ImmichError = err.Error()
 	}
 
-	config.Email = immich.Notifications.SMTP.Transport.Username
-
-	if immich.Notifications.SMTP.Transport.Password != "" {
-		slog.Debug("IF was met")
-		config.EmailPass = true
-	} else {
-		slog.Debug("ELSE was met")
-		config.EmailPass = false
+	config.ComposeEnv, err = loadComposeEnv(composeEnvPath())
+	if err != nil {
+		slog.Debug("Error reading compose .env", "err", err)
 	}
-	slog.Debug("Password Boolean", "EmailPass", config.EmailPass)
 
-	return &config, nil
+	return config, nil
 }
 
 func CopyFile(src, dst string) error {
@@ -281,31 +259,9 @@ func CopyFile(src, dst string) error {
 	return nil
 }
 
-func switchConfig() error {
-	slog.Debug("switchConfig()")
-	configPath := nixDir + "configuration.nix"
-	backupPath := nixDir + "configuration.old"
-	tmpPath := nixDir + "configuration.tmp"
-
-	slog.Info("Backing up configuration.nix to configuration.old...")
-	if err := CopyFile(configPath, backupPath); err != nil {
-		slog.Debug("Error backing up config file", "err", err)
-		return err
-	}
-
-	slog.Info("Replacing configuration.nix with configuration.tmp...")
-	if err := CopyFile(tmpPath, configPath); err != nil {
-		slog.Debug("Error replacing config file", "err", err)
-		return err
-	}
-
-	slog.Info("Configuration file swtich complete.")
-	return nil
-}
-
 func applyChanges() error {
 	slog.Debug("applyChanges()")
-	cmd := exec.Command("nixos-rebuild", "switch")
+	cmd := exec.Command("nixos-rebuild", rebuildArgs(nixDir, "switch")...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -371,65 +327,14 @@ func updateImmichContainer() error {
 	return nil
 }
 
-func getImmichConfig() (*ImmichConfig, error) { // Really no idea if this one is right. Seems like a lot happening
+func getImmichConfig() (*ImmichConfig, error) {
 	slog.Debug("getImmichConfig()")
-	file, err := os.Open(tankImmich + "immich-config.json")
+	byteValue, err := os.ReadFile(tankImmich + "immich-config.json")
 	if err != nil {
 		slog.Debug("| Error opening immich config file |", "err", err)
 		return nil, err
 	}
-	defer file.Close()
-
-	byteValue, _ := io.ReadAll(file)
-
-	var immichConfig ImmichConfig
-
-	json.Unmarshal(byteValue, &immichConfig)
-
-	return &immichConfig, nil
-}
-
-func setImmichConfig(email string, password string) error {
-	slog.Debug("setImmichConfig()")
-	// NOT using templating becuase we've got all the JSON we need... should cut down on errors but we need a "default" value somewhere
-	immichConfig, err := getImmichConfig()
-	if err != nil {
-		slog.Debug("Error reading immich config file", "err", err)
-		return err
-	}
-
-	immichConfig.Notifications.SMTP.From = "Immich Server <" + email + ">"
-	immichConfig.Notifications.SMTP.Transport.Username = email
-	immichConfig.Notifications.SMTP.Transport.Password = password
-
-	if email == "" || password == "" {
-		immichConfig.Notifications.SMTP.Enabled = false
-	} else {
-		immichConfig.Notifications.SMTP.Enabled = true
-	}
-
-	b, err := json.MarshalIndent(immichConfig, "", "  ")
-	if err != nil {
-		slog.Debug("Error generating JSON", "err", err)
-		return err
-	}
-
-	slog.Debug(string(b))
-
-	fileName := tankImmich + "immich-config.tmp"
-
-	if err := os.WriteFile(fileName, b, 0644); err != nil {
-		slog.Debug("Error writing to file:", "err", err)
-		return err
-	}
-
-	configFile := tankImmich + "immich-config.json"
-
-	CopyFile(fileName, configFile)
-
-	slog.Info("Immich config Set")
-
-	return nil
+	return parseImmichConfig(byteValue)
 }
 
 func getEligibleDisks() ([]EligibleDisk, error) {
@@ -632,7 +537,7 @@ func handleRoot(
 		return
 	}
 
-	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/index.html")
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/index.html", "internal/templates/web/immichsettings.html")
 	if err != nil {
 		slog.Error("| Error rendering template |", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -659,14 +564,108 @@ func handleSave(
 	slog.Debug("Received Form", "body", r.Form)
 
 	config := &NixConfig{
-		TimeZone:    r.FormValue("timezone"),
-		AutoUpgrade: parseBool(r.FormValue("auto-updates")),
-		UpgradeTime: r.FormValue("update-time"),
-		Tailscale:   parseBool(r.FormValue("tailscale")),
-		TSAuthkey:   r.FormValue("tailscale-authkey"),
+		SystemSettings: SystemSettings{
+			Flake:        r.FormValue("nix-mode") == "flake",
+			TimeZone:     r.FormValue("timezone"),
+			AutoUpgrade:  parseBool(r.FormValue("auto-updates")),
+			UpgradeTime:  strings.Join(strings.Fields(r.FormValue("update-time")), " "),
+			UpgradeDelay: strings.TrimSpace(r.FormValue("update-delay")),
+			Locale:       r.FormValue("locale"),
+			Formats:      r.FormValue("formats"),
+			Keymap:       r.FormValue("keymap"),
+			NixGC:        parseBool(r.FormValue("nix-gc")),
+			NixGCDates:   strings.Join(strings.Fields(r.FormValue("nix-gc-dates")), " "),
+		},
+		NetworkingSettings: NetworkingSettings{
+			Hostname:   strings.ToLower(strings.TrimSpace(r.FormValue("hostname"))),
+			Interfaces: parseInterfaceForm(r),
+		},
+		SSHSettings: SSHSettings{
+			SSH:             parseBool(r.FormValue("ssh")),
+			SSHUser:         strings.TrimSpace(r.FormValue("ssh-user")),
+			SSHPasswordAuth: parseBool(r.FormValue("ssh-password")),
+			AuthorizedKeys:  parseAuthorizedKeys(r.FormValue("authorized-keys")),
+		},
+		RemoteAccessSettings: RemoteAccessSettings{
+			Tailscale: parseBool(r.FormValue("tailscale")),
+			TSAuthkey: r.FormValue("tailscale-authkey"),
+		},
+	}
+
+	if err := validateTimezone(config.TimeZone); err != nil {
+		slog.Error("| Invalid timezone |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config.UpgradeWindow, err = strconv.Atoi(r.FormValue("reboot-window"))
+	if err != nil {
+		slog.Error("| Invalid reboot window |", "err", err)
+		http.Error(w, "Reboot window must be a number of minutes", http.StatusBadRequest)
+		return
+	}
+
+	config.NixGCDays, err = strconv.Atoi(r.FormValue("nix-gc-days"))
+	if err != nil {
+		slog.Error("| Invalid garbage collection age |", "err", err)
+		http.Error(w, "Garbage collection age must be a number of days", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateNixGC(config.SystemSettings); err != nil {
+		slog.Error("| Invalid garbage collection settings |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateUpgradeSchedule(config.SystemSettings); err != nil {
+		slog.Error("| Invalid upgrade schedule |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateLocale(config.SystemSettings); err != nil {
+		slog.Error("| Invalid locale |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateSSH(config.SSHSettings); err != nil {
+		slog.Error("| Invalid SSH settings |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateHostname(config.Hostname); err != nil {
+		slog.Error("| Invalid hostname |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config.Firewall, err = parseFirewallForm(r)
+	if err != nil {
+		slog.Error("| Invalid firewall settings |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := validateInterfaces(config.Interfaces); err != nil {
+		slog.Error("| Invalid network settings |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	snapshots, err := parseSnapshotForm(r)
+	if err == nil {
+		err = validateSnapshots(snapshots)
+	}
+	if err != nil {
+		slog.Error("| Invalid snapshot settings |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	t1, t2, err := getLowerUpper(config.UpgradeTime)
+	t1, t2, err := getLowerUpper(config.UpgradeTime, config.UpgradeWindow)
 	if err != nil {
 		slog.Error("| Error calculating time setting |", "err", err)
 		http.Error(w, "Issue with time setting"+err.Error(), http.StatusInternalServerError)
@@ -675,6 +674,25 @@ func handleSave(
 	config.UpgradeLower = t1
 	config.UpgradeUpper = t2
 
+	// Users are edited on their own page and the hostId never changes, keep what's already configured
+	base, err := loadBaseConfig()
+	if err != nil {
+		slog.Error("| Error loading users |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	config.UserSettings = base.UserSettings
+	config.ZFSSettings = base.ZFSSettings
+	// users.nix is rewritten with every save, so a config without an admin can't be saved from here either
+	if err := validateUsers(config.Users); err != nil {
+		slog.Error("| Invalid users |", "err", err)
+		http.Error(w, "Fix the users on the Users page first:\n"+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(snapshots) > 0 {
+		config.Snapshots = snapshots
+	}
+
 	slog.Debug("Updated config", "config", config)
 
 	err = saveTmpFile(config)
@@ -691,193 +709,942 @@ func handleSave(
 		return
 	}
 
-	tmpl.Execute(w, config)
+	tmpl.Execute(w, SavePage{NixConfig: config, Warnings: firewallWarnings(config.Firewall, clientAddr(r))})
 }
 
-// APPLY will eventually become much more complicated with a modal pop-up, error checking, rollback, etc. enbaled (presumably) by HTMX
-func handleApply(
+func handleValidate(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	slog.Info("Received Apply Request")
+	slog.Info("Received Validate Request")
 
-	if err := switchConfig(); err != nil {
-		slog.Error("| Error when switching config files |", "err", err)
+	result, err := validateConfig(r.Context())
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "No saved configuration to validate. Save a configuration from the admin panel first.", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("| Error validating config |", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := applyChanges(); err != nil {
-		slog.Error("| Error Applying Changes |", "err", err)
+	// Show the saved values again, now with any errors next to them
+	config, err := loadNixConfig(nixDir, ".tmp")
+	if err != nil {
+		slog.Debug("Saved config could not be loaded for display", "err", err)
+		config = &NixConfig{}
+	} else if lower, upper, err := getLowerUpper(config.UpgradeTime, config.UpgradeWindow); err == nil {
+		config.UpgradeLower = lower
+		config.UpgradeUpper = upper
+	}
+
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/save.html")
+	if err != nil {
+		slog.Error("| Error rendering save template |", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// To-Do make a better confirmation page
-	w.Write([]byte("Rebuild Completed Successfully"))
+	tmpl.Execute(w, SavePage{NixConfig: config, Validation: result, Warnings: firewallWarnings(config.Firewall, clientAddr(r))})
 }
 
-func handleStatus(
+// APPLY rebuilds with the validated config, then waits for the admin to confirm it (see rollback.go)
+func handleApply(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	// fmt.Println("Received Status Request")
-	slog.Debug("Received Status Request")
-	w.Write([]byte(getStatus()))
+	slog.Info("Received Apply Request")
+
+	if !isValidated() {
+		slog.Error("| Refusing to apply configuration that has not passed validation |")
+		http.Error(w, "The saved configuration must pass validation before it can be applied.", http.StatusConflict)
+		return
+	}
+
+	if getPending() != nil {
+		http.Error(w, "The last applied configuration is still waiting to be confirmed.", http.StatusConflict)
+		return
+	}
+
+	if hostUpdateRunning() {
+		http.Error(w, "A host update is running, apply the configuration once it has finished.", http.StatusConflict)
+		return
+	}
+
+	apply, err := applyWithRollback(requestActor(r))
+	if err != nil {
+		slog.Error("| Error Applying Changes |", "err", err)
+		http.Error(w, err.Error(), pendingStatus(err))
+		return
+	}
+
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/confirm.html")
+	if err != nil {
+		slog.Error("| Error rendering confirm template |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl.Execute(w, apply)
 }
 
-func handleStop(
+func handlePending(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	slog.Info("Received Stop Request")
+	slog.Debug("Received Pending Request")
 
-	err := immichService("stop")
+	apply := getPending()
+	if apply == nil {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/confirm.html")
 	if err != nil {
-		slog.Error("| Error stopping immich-app.service |", "err", err)
-		http.Error(w, "Issue stopping Immich"+err.Error(), http.StatusInternalServerError)
+		slog.Error("| Error rendering confirm template |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
 
-	// w.Write([]byte(getStatus()))
+	tmpl.Execute(w, apply)
 }
 
-func handleStart(
+func handleConfirm(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	slog.Info("Received Start Request")
+	slog.Info("Received Confirm Request")
 
-	err := immichService("start")
-	if err != nil {
-		slog.Error("| Error starting immich-app.service |", "err", err)
-		http.Error(w, "Issue starting Immich"+err.Error(), http.StatusInternalServerError)
+	if !confirmPending() {
+		http.Error(w, "No configuration is waiting for confirmation. It may already have been rolled back.", http.StatusConflict)
+		return
 	}
 
-	// w.Write([]byte(getStatus()))
+	w.Write([]byte("Configuration kept. Return to the admin panel."))
 }
 
-func handleUpdate(
+func handleRevert(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	slog.Info("Received Update Request")
-
-	if err := immichService("stop"); err != nil {
-		slog.Error("| Error stopping immich-app.service |", "err", err)
-		http.Error(w, "Issue stopping Immich"+err.Error(), http.StatusInternalServerError)
-	}
+	slog.Info("Received Revert Request")
 
-	if err := updateImmichContainer(); err != nil {
-		slog.Error("| Error updating Immich |", "err", err)
+	if err := revertPending(); err != nil {
+		slog.Error("| Error reverting configuration |", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := immichService("start"); err != nil {
-		slog.Error("| Error starting immich-app.service |", "err", err)
-		http.Error(w, "Issue starting Immich"+err.Error(), http.StatusInternalServerError)
-	}
-
-	w.Write([]byte("Pulled new containers successfully"))
-
+	w.Write([]byte("Previous configuration restored. Return to the admin panel."))
 }
 
-// This function is a tad messy and ought to be cleaned up
-func handleEmailPost(
+func handleDiff(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	slog.Info("Received Email Post")
+	slog.Info("Received Diff Request")
 
-	err := r.ParseForm()
-	if err != nil {
-		slog.Error("| Error parsing email form submission |", "err", err)
-		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+	diffs, err := diffSavedConfig()
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "No saved configuration to compare. Save a configuration from the admin panel first.", http.StatusNotFound)
 		return
 	}
-
-	// Do I need to validate submitted values in some way?
-	if err := setImmichConfig(r.FormValue("gmail-address"), r.FormValue("gmail-password")); err != nil {
-		slog.Error("| Failed to set Immich config |", "err", err)
-		http.Error(w, "Failed to set Immich config.", http.StatusInternalServerError)
+	if err != nil {
+		slog.Error("| Error comparing configuration files |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	// The rest of the function below this line should probably be tidied up and refactored
-	config := NixConfig{}
-
-	// Parse settings out of immich-config.json - might need to refactor these 15 lines out into a function to maintan DRY best practice
-	// (Also see repeated code in the "loadCurrentConfig()" function)
-	immich, err := getImmichConfig()
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/diff.html", "internal/templates/web/difftable.html")
 	if err != nil {
-		slog.Error("| Error parisng immich-config.json |", "err", err)
+		slog.Error("| Error rendering diff template |", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	config.Email = immich.Notifications.SMTP.Transport.Username
-	if immich.Notifications.SMTP.Transport.Password != "" {
-		slog.Debug("Contains Password = True")
-		config.EmailPass = true
-	} else {
-		slog.Debug("Contains Password = False")
-		config.EmailPass = false
-	}
-
-	htmlStr := `    <form id="email-form" action="/email" method="post">
-        <label for="gmail-address">Gmail Address:</label>
-        <input type="email" id="gmail-address" name="gmail-address" placeholder="example@gmail.com" value="{{if .Email}}{{.Email}}{{else}}{{end}}">        <label for="gmail-password">Gmail App Password:</label>
-        <input type="password" id="gmail-password" name="gmail-password" placeholder="{{if .EmailPass}}password is set{{else}}fded beid aibr kxps{{end}}">
-        <button type="submit" hx-post="/email" hx-target="#email-form">Submit</button>
-        <br><small>Use your gmail account with an <a href="https://support.google.com/mail/answer/185833">app password</a> to allow for immich to send emails</small>
-    </form>`
-	// // need to store and parse return before writing it
-	tmpl, _ := htmltemplate.New("t").Parse(htmlStr)
-	tmpl.Execute(w, config)
+	tmpl.Execute(w, DiffPage{Diffs: diffs, Validated: isValidated()})
 }
 
-func handlePoweroff(
+func handleDiffJSON(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	slog.Info("Received Poweroff Request")
-
-	cmd := exec.Command("poweroff")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	slog.Debug("Received Diff JSON Request")
 
-	err := cmd.Run()
+	diffs, err := diffSavedConfig()
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "No saved configuration to compare", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		slog.Error("| Error executing poweroff |", "err", err)
-		http.Error(w, "Failed to execute poweroff", http.StatusInternalServerError)
+		slog.Error("| Error comparing configuration files |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(diffs)
 }
 
-func handleReboot(
+func handleGenerations(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	slog.Info("Received Reboot Request")
+	slog.Info("Received Generations Request")
 
-	cmd := exec.Command("reboot")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	generations, err := listGenerations(profileDir)
+	if err != nil {
+		slog.Error("| Error listing generations |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	err := cmd.Run()
+	store, err := storeUsage(nixStore)
 	if err != nil {
-		slog.Error("| Error executing reboot |", "err", err)
-		http.Error(w, "Failed to execute reboot", http.StatusInternalServerError)
+		slog.Debug("Error reading store usage", "err", err)
+	}
+
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/generations.html")
+	if err != nil {
+		slog.Error("| Error rendering generations template |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
 	}
+
+	tmpl.Execute(w, GenerationsPage{Generations: generations, Store: store, Collected: r.URL.Query().Get("freed")})
 }
 
-func handleGetDisks(
+func handleRollbackGeneration(
 	w http.ResponseWriter,
 	r *http.Request,
 ) {
-	disks, err := getEligibleDisks()
-	if err != nil {
-		slog.Error("Error getting eiligible disks", "err", err)
-	}
+	slog.Info("Received Rollback Request")
+
+	if err := rollbackGeneration(); err != nil {
+		slog.Error("| Error rolling back generation |", "err", err)
+		http.Error(w, err.Error(), pendingStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, "/generations", http.StatusSeeOther)
+}
+
+func handleSwitchGeneration(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Switch Generation Request", "number", r.PathValue("number"))
+
+	number, err := strconv.Atoi(r.PathValue("number"))
+	if err != nil {
+		http.Error(w, "Invalid generation number", http.StatusBadRequest)
+		return
+	}
+
+	if err := switchGeneration(number); err != nil {
+		slog.Error("| Error switching generation |", "err", err)
+		http.Error(w, err.Error(), pendingStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, "/generations", http.StatusSeeOther)
+}
+
+func handleCollectGenerations(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Generation GC Request")
+
+	if err := r.ParseForm(); err != nil {
+		slog.Error("| Error parsing form |", "err", err)
+		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+
+	keep, err := strconv.Atoi(r.FormValue("keep"))
+	if err != nil || keep < 1 {
+		http.Error(w, "Number of generations to keep must be at least 1", http.StatusBadRequest)
+		return
+	}
+
+	if err := collectGenerations(keep); err != nil {
+		slog.Error("| Error collecting generations |", "err", err)
+		http.Error(w, err.Error(), pendingStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, "/generations", http.StatusSeeOther)
+}
+
+func handleCollectGarbage(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Nix Store GC Request")
+
+	if err := r.ParseForm(); err != nil {
+		slog.Error("| Error parsing form |", "err", err)
+		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+
+	days, err := strconv.Atoi(r.FormValue("days"))
+	if err != nil || days < 1 {
+		http.Error(w, "Age must be at least 1 day", http.StatusBadRequest)
+		return
+	}
+
+	summary, err := collectGarbage(days)
+	if err != nil {
+		slog.Error("| Error collecting garbage |", "err", err)
+		http.Error(w, err.Error(), pendingStatus(err))
+		return
+	}
+	if summary == "" {
+		summary = "nothing to collect"
+	}
+
+	http.Redirect(w, r, "/generations?freed="+url.QueryEscape(summary), http.StatusSeeOther)
+}
+
+func handleHistory(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received History Request")
+
+	revisions, err := listRevisions()
+	if err != nil {
+		slog.Error("| Error listing revisions |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/history.html")
+	if err != nil {
+		slog.Error("| Error rendering history template |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl.Execute(w, revisions)
+}
+
+func handleRevision(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Revision Request", "id", r.PathValue("id"))
+
+	rev, err := getRevision(r.PathValue("id"))
+	if err != nil {
+		slog.Error("| Error reading revision |", "err", err)
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	diffs, err := diffRevision(rev)
+	if err != nil {
+		slog.Error("| Error comparing revision |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/revision.html", "internal/templates/web/difftable.html")
+	if err != nil {
+		slog.Error("| Error rendering revision template |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl.Execute(w, struct {
+		Revision *Revision
+		Diffs    []*ConfigDiff
+	}{rev, diffs})
+}
+
+func handleRevisionFile(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Debug("Received Revision File Request", "id", r.PathValue("id"), "file", r.PathValue("file"))
+
+	rev, err := getRevision(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	path, err := revisionFilePath(rev, r.PathValue("file"))
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// Redacted again in case the revision was recorded before passwords were
+	b, err := readRedacted(r.PathValue("file"), path)
+	if err != nil {
+		slog.Error("| Error reading revision file |", "err", err)
+		http.Error(w, "Failed to read file", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(b)
+}
+
+func handleRestoreRevision(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Restore Revision Request", "id", r.PathValue("id"))
+
+	rev, err := getRevision(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "Revision not found", http.StatusNotFound)
+		return
+	}
+
+	if err := restoreRevision(rev, requestActor(r)); err != nil {
+		slog.Error("| Error restoring revision |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// NixOS revisions are now the saved config and go through review, validate and apply like any other
+	if rev.Kind == revisionNixOS {
+		http.Redirect(w, r, "/diff", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/history", http.StatusSeeOther)
+}
+
+func handleTimezones(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Debug("Received Timezones Request")
+
+	zones, err := listTimezones()
+	if err != nil {
+		slog.Error("| Error listing timezones |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Case-insensitive substring search, so "york" finds America/New_York
+	if q := strings.ToLower(r.URL.Query().Get("q")); q != "" {
+		matches := []string{}
+		for _, zone := range zones {
+			if strings.Contains(strings.ToLower(zone), q) {
+				matches = append(matches, zone)
+			}
+		}
+		zones = matches
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zones)
+}
+
+func handleUsers(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Users Request")
+
+	config, err := loadBaseConfig()
+	if err != nil {
+		slog.Error("| Error loading config |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/users.html")
+	if err != nil {
+		slog.Error("| Error rendering template |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl.Execute(w, config)
+}
+
+func handleUsersPost(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Users Save Request")
+
+	if err := r.ParseForm(); err != nil {
+		slog.Error("| Error parsing form |", "err", err)
+		http.Error(w, "Failed to parse form data", http.StatusBadRequest)
+		return
+	}
+
+	config, err := loadBaseConfig()
+	if err != nil {
+		slog.Error("| Error loading config |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	users, err := parseUsersForm(r, config.Users)
+	if err != nil {
+		slog.Error("| Error reading users |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validateUsers(users); err != nil {
+		slog.Error("| Invalid users |", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	config.Users = users
+
+	if err := saveTmpFile(config); err != nil {
+		slog.Error("| Error saving tmp file |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/diff", http.StatusSeeOther)
+}
+
+// handleSchedule previews the next runs of an upgrade schedule while it's being typed
+func handleSchedule(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Debug("Received Schedule Request")
+
+	settings := SystemSettings{
+		UpgradeTime: strings.Join(strings.Fields(r.FormValue("update-time")), " "),
+		TimeZone:    r.FormValue("timezone"),
+	}
+	if _, err := parseCalendar(settings.UpgradeTime); err != nil {
+		tmpl, _ := htmltemplate.New("t").Parse(`<span class="error">{{.}}</span>`)
+		tmpl.Execute(w, err.Error())
+		return
+	}
+
+	htmlStr := `{{range .NextUpgrades}}<li>{{.Format "Mon 2006-01-02 15:04:05 MST"}}</li>{{else}}<li>never</li>{{end}}`
+	tmpl, _ := htmltemplate.New("t").Parse(htmlStr)
+	tmpl.Execute(w, settings)
+}
+
+func handleHostUpdate(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Host Update Page Request")
+
+	var page *HostUpdate
+	if job := latestHostUpdate(); job != nil {
+		snapshot := job.Snapshot()
+		page = &snapshot
+	}
+
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/hostupdate.html")
+	if err != nil {
+		slog.Error("| Error rendering template |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tmpl.Execute(w, page)
+}
+
+func handleStartHostUpdate(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Host Update Request")
+
+	if _, err := startHostUpdate(); err != nil {
+		slog.Error("| Error starting host update |", "err", err)
+		http.Error(w, err.Error(), pendingStatus(err))
+		return
+	}
+
+	http.Redirect(w, r, "/host-update", http.StatusSeeOther)
+}
+
+// handleHostUpdateLog streams the update's output as plain text until it finishes or the client
+// goes away
+func handleHostUpdateLog(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Debug("Received Host Update Log Request")
+
+	job := latestHostUpdate()
+	if job == nil {
+		http.Error(w, "No host update has been run since the web UI started.", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	flusher, _ := w.(http.Flusher)
+	offset := 0
+	for {
+		out, next, done, changed := job.Output(offset)
+		if len(out) > 0 {
+			if _, err := w.Write(out); err != nil {
+				return
+			}
+			offset = next
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if done {
+			return
+		}
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func handleFlakeUpdate(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Flake Update Request")
+
+	if err := stageFlakeUpdate(); err != nil {
+		slog.Error("| Error updating flake.lock |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(w, r, "/diff", http.StatusSeeOther)
+}
+
+func handleStatus(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	// fmt.Println("Received Status Request")
+	slog.Debug("Received Status Request")
+	w.Write([]byte(getStatus()))
+}
+
+func handleStop(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Stop Request")
+
+	err := immichService("stop")
+	if err != nil {
+		slog.Error("| Error stopping immich-app.service |", "err", err)
+		http.Error(w, "Issue stopping Immich"+err.Error(), http.StatusInternalServerError)
+	}
+
+	// w.Write([]byte(getStatus()))
+}
+
+func handleStart(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Start Request")
+
+	err := immichService("start")
+	if err != nil {
+		slog.Error("| Error starting immich-app.service |", "err", err)
+		http.Error(w, "Issue starting Immich"+err.Error(), http.StatusInternalServerError)
+	}
+
+	// w.Write([]byte(getStatus()))
+}
+
+func handleUpdate(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Update Request")
+
+	if err := immichService("stop"); err != nil {
+		slog.Error("| Error stopping immich-app.service |", "err", err)
+		http.Error(w, "Issue stopping Immich"+err.Error(), http.StatusInternalServerError)
+	}
+
+	if err := updateImmichContainer(); err != nil {
+		slog.Error("| Error updating Immich |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := immichService("start"); err != nil {
+		slog.Error("| Error starting immich-app.service |", "err", err)
+		http.Error(w, "Issue starting Immich"+err.Error(), http.StatusInternalServerError)
+	}
+
+	w.Write([]byte("Pulled new containers successfully"))
+
+}
+
+func handleEmailPost(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Email Post")
+
+	saveImmichForm(w, r, "immich-smtp", func(immich *ImmichConfig) error {
+		if err := parseSMTPForm(r, &immich.Notifications.SMTP); err != nil {
+			return err
+		}
+		return validateSMTP(immich.Notifications.SMTP)
+	})
+}
+
+// handleTestEmail sends a test email with the saved SMTP settings and reports each step
+func handleTestEmail(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Test Email Request")
+
+	immich, err := getImmichConfig()
+	if err != nil {
+		slog.Error("| Error parsing immich-config.json |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	to := strings.TrimSpace(r.FormValue("test-to"))
+	if to == "" {
+		to = immich.Notifications.SMTP.From
+	}
+	result := sendTestEmail(r.Context(), immich.Notifications.SMTP, to)
+
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/immichsettings.html")
+	if err != nil {
+		slog.Error("| Error rendering template |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.ExecuteTemplate(w, "immich-smtp-test", result)
+}
+
+// handleSMTPPreset renders the email form with a provider's host and port filled in, keeping what
+// was already typed into the other fields
+func handleSMTPPreset(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Debug("Received SMTP Preset Request")
+
+	immich, err := getImmichConfig()
+	if err != nil {
+		slog.Error("| Error parsing immich-config.json |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	form := immich.Form()
+	if err := parseSMTPForm(r, &immich.Notifications.SMTP); err != nil {
+		form.Error = err.Error()
+	}
+	applySMTPPreset(&immich.Notifications.SMTP, r.FormValue("smtp-preset"))
+	renderImmichForm(w, "immich-smtp", form)
+}
+
+// saveImmichForm validates and writes the settings update applied to immich-config.json, then renders
+// the form again with the result
+func saveImmichForm(
+	w http.ResponseWriter,
+	r *http.Request,
+	name string,
+	update func(*ImmichConfig) error,
+) {
+	immich, err := getImmichConfig()
+	if err != nil {
+		slog.Error("| Error parsing immich-config.json |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := update(immich); err != nil {
+		slog.Error("| Invalid Immich settings |", "form", name, "err", err)
+		// Render what was submitted so it can be corrected
+		form := immich.Form()
+		form.Error = err.Error()
+		renderImmichForm(w, name, form)
+		return
+	}
+
+	if err := writeImmichConfig(immich); err != nil {
+		slog.Error("| Failed to set Immich config |", "err", err)
+		http.Error(w, "Failed to set Immich config.", http.StatusInternalServerError)
+		return
+	}
+	if _, err := recordRevision(revisionImmich, requestActor(r), "saved", map[string]string{"immich-config.json": tankImmich + "immich-config.json"}); err != nil {
+		slog.Error("| Failed to record Immich config revision |", "err", err)
+	}
+
+	form := immich.Form()
+	form.Saved = true
+	renderImmichForm(w, name, form)
+}
+
+func renderImmichForm(w http.ResponseWriter, name string, form ImmichForm) {
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/immichsettings.html")
+	if err != nil {
+		slog.Error("| Error rendering template |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.ExecuteTemplate(w, name, form)
+}
+
+func handleImmichServerPost(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Immich Server Settings Post")
+
+	saveImmichForm(w, r, "immich-server", func(immich *ImmichConfig) error {
+		immich.Server.ExternalDomain = strings.TrimSuffix(strings.TrimSpace(r.FormValue("external-domain")), "/")
+		immich.Server.LoginPageMessage = strings.TrimSpace(r.FormValue("login-page-message"))
+		immich.Server.PublicUsers = parseBool(r.FormValue("public-users"))
+		return validateServer(immich.Server)
+	})
+}
+
+func handleStorageTemplatePost(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Storage Template Post")
+
+	saveImmichForm(w, r, "immich-storage-template", func(immich *ImmichConfig) error {
+		immich.StorageTemplate.Enabled = parseBool(r.FormValue("storage-template-enabled"))
+		immich.StorageTemplate.HashVerificationEnabled = parseBool(r.FormValue("storage-hash-verification"))
+		immich.StorageTemplate.Template = strings.TrimSpace(r.FormValue("storage-template"))
+		return validateStorageTemplate(immich.StorageTemplate)
+	})
+}
+
+func handleStorageTemplatePreview(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Debug("Received Storage Template Preview Request")
+
+	form := ImmichForm{}
+	preview, err := storageTemplatePreview(strings.TrimSpace(r.FormValue("storage-template")))
+	if err != nil {
+		form.PreviewError = err.Error()
+	}
+	form.Preview = preview
+	renderImmichForm(w, "immich-storage-preview", form)
+}
+
+func handleDatabaseBackupPost(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Database Backup Settings Post")
+
+	saveImmichForm(w, r, "immich-backup", func(immich *ImmichConfig) error {
+		immich.Backup.Database.Enabled = parseBool(r.FormValue("db-backup-enabled"))
+		immich.Backup.Database.CronExpression = strings.Join(strings.Fields(r.FormValue("db-backup-cron")), " ")
+		keep, err := strconv.Atoi(strings.TrimSpace(r.FormValue("db-backup-keep")))
+		if err != nil {
+			return fmt.Errorf("database backups to keep must be a number")
+		}
+		immich.Backup.Database.KeepLastAmount = keep
+		return validateDatabaseBackup(immich.Backup.Database)
+	})
+}
+
+func handleComposeEnvPost(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Compose Env Post")
+
+	config, err := loadComposeEnv(composeEnvPath())
+	if err != nil {
+		slog.Error("| Error reading compose .env |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	form := ComposeEnvForm{ComposeEnv: config}
+	config.ImmichVersion = strings.TrimSpace(r.FormValue("immich-version"))
+	if err := validateComposeEnv(config); err != nil {
+		slog.Error("| Invalid compose .env settings |", "err", err)
+		form.Error = err.Error()
+	} else if err := saveComposeEnv(composeEnvPath(), config); err != nil {
+		slog.Error("| Error saving compose .env |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	} else {
+		form.Saved = true
+	}
+
+	tmpl, err := htmltemplate.ParseFS(templates, "internal/templates/web/immichsettings.html")
+	if err != nil {
+		slog.Error("| Error rendering template |", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tmpl.ExecuteTemplate(w, "immich-env", form)
+}
+
+func handlePoweroff(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Poweroff Request")
+
+	cmd := exec.Command("poweroff")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		slog.Error("| Error executing poweroff |", "err", err)
+		http.Error(w, "Failed to execute poweroff", http.StatusInternalServerError)
+	}
+}
+
+func handleReboot(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	slog.Info("Received Reboot Request")
+
+	cmd := exec.Command("reboot")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		slog.Error("| Error executing reboot |", "err", err)
+		http.Error(w, "Failed to execute reboot", http.StatusInternalServerError)
+	}
+}
+
+func handleGetDisks(
+	w http.ResponseWriter,
+	r *http.Request,
+) {
+	disks, err := getEligibleDisks()
+	if err != nil {
+		slog.Error("Error getting eiligible disks", "err", err)
+	}
 
 	// for _, disk := range disks {
 	// 	fmt.Println(disk.PartitionLabel + " | " + disk.PartitionSize + " | " + disk.Model)
@@ -990,18 +1757,51 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("GET /{$}", handleRoot)
 	mux.HandleFunc("POST /save", handleSave)
+	mux.HandleFunc("POST /validate", handleValidate)
 	mux.HandleFunc("POST /apply", handleApply)
+	mux.HandleFunc("GET /pending", handlePending)
+	mux.HandleFunc("POST /confirm", handleConfirm)
+	mux.HandleFunc("POST /revert", handleRevert)
+	mux.HandleFunc("GET /diff", handleDiff)
+	mux.HandleFunc("GET /diff.json", handleDiffJSON)
+	mux.HandleFunc("GET /history", handleHistory)
+	mux.HandleFunc("GET /history/{id}", handleRevision)
+	mux.HandleFunc("GET /history/{id}/{file}", handleRevisionFile)
+	mux.HandleFunc("POST /history/{id}/restore", handleRestoreRevision)
+	mux.HandleFunc("GET /generations", handleGenerations)
+	mux.HandleFunc("POST /generations/rollback", handleRollbackGeneration)
+	mux.HandleFunc("POST /generations/{number}/switch", handleSwitchGeneration)
+	mux.HandleFunc("POST /generations/gc", handleCollectGenerations)
+	mux.HandleFunc("POST /generations/collect-garbage", handleCollectGarbage)
+	mux.HandleFunc("POST /flake/update", handleFlakeUpdate)
+	mux.HandleFunc("GET /host-update", handleHostUpdate)
+	mux.HandleFunc("POST /host-update", handleStartHostUpdate)
+	mux.HandleFunc("GET /host-update/log", handleHostUpdateLog)
+	mux.HandleFunc("GET /timezones", handleTimezones)
+	mux.HandleFunc("GET /schedule", handleSchedule)
+	mux.HandleFunc("GET /users", handleUsers)
+	mux.HandleFunc("POST /users", handleUsersPost)
 	mux.HandleFunc("GET /status", handleStatus)
 	mux.HandleFunc("POST /stop", handleStop)
 	mux.HandleFunc("POST /start", handleStart)
 	mux.HandleFunc("POST /update", handleUpdate)
 	mux.HandleFunc("POST /email", handleEmailPost)
+	mux.HandleFunc("GET /email/preset", handleSMTPPreset)
+	mux.HandleFunc("POST /email/test", handleTestEmail)
+	mux.HandleFunc("POST /immich/server", handleImmichServerPost)
+	mux.HandleFunc("POST /immich/storage-template", handleStorageTemplatePost)
+	mux.HandleFunc("GET /immich/storage-template/preview", handleStorageTemplatePreview)
+	mux.HandleFunc("POST /immich/backup", handleDatabaseBackupPost)
+	mux.HandleFunc("POST /immich/env", handleComposeEnvPost)
 	mux.HandleFunc("POST /poweroff", handlePoweroff)
 	mux.HandleFunc("POST /reboot", handleReboot)
 	mux.HandleFunc("GET /disks", handleGetDisks)
 	mux.HandleFunc("POST /backup", handleBackup)
 	mux.HandleFunc("GET /backupstatus", handleGetBackupStatus)
 
+	// Pick up a confirmation window that was interrupted by a restart
+	resumePending()
+
 	// Probably need a 404/Error page that hyperlinks back to the main page
 
 	// Need to make debug mode dynamic
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const sysClassNet = "/sys/class/net"
+
+// NetworkInterface is the addressing for one wired interface. Static addresses are written as a
+// NetworkManager profile so NetworkManager keeps managing the interface either way.
+type NetworkInterface struct {
+	Name        string
+	Static      bool
+	IPv4Address string   // CIDR, e.g. 192.168.1.10/24
+	IPv4Gateway string   // optional
+	IPv6Address string   // CIDR, optional, SLAAC is used when empty
+	IPv6Gateway string   // optional
+	DNS         []string // IPv4 and IPv6 servers
+	Detected    bool     // present in /sys/class/net, only set by loadCurrentConfig
+}
+
+// DNS4 and DNS6 format the servers the way NetworkManager's ipv4.dns and ipv6.dns expect them
+func (n NetworkInterface) DNS4() string { return nmDNSList(n.DNS, true) }
+func (n NetworkInterface) DNS6() string { return nmDNSList(n.DNS, false) }
+
+func nmDNSList(servers []string, v4 bool) string {
+	var b strings.Builder
+	for _, server := range servers {
+		if addr, err := netip.ParseAddr(server); err == nil && addr.Is4() == v4 {
+			b.WriteString(server + ";")
+		}
+	}
+	return b.String()
+}
+
+func (s NetworkingSettings) StaticInterfaces() []NetworkInterface {
+	var static []NetworkInterface
+	for _, iface := range s.Interfaces {
+		if iface.Static {
+			static = append(static, iface)
+		}
+	}
+	return static
+}
+
+var interfaceNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+// A single DNS label, so <hostname>.local is a valid mDNS name
+var hostnameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// Immich's external domain is only kept in sync while it points at the mDNS name. Anything else was set
+// by the admin (a reverse proxy or tunnel) and is left alone.
+var mdnsDomainRe = regexp.MustCompile(`^http://[a-z0-9-]+\.local/?$`)
+
+func validateHostname(hostname string) error {
+	if !hostnameRe.MatchString(hostname) {
+		return fmt.Errorf("hostname %q must be 1-63 lowercase letters, digits or hyphens and can't start or end with a hyphen", hostname)
+	}
+	return nil
+}
+
+// syncImmichDomain points Immich's server.externalDomain at the current mDNS name so links in emails
+// and shared albums keep working after a hostname change. It reports whether the config was changed.
+func syncImmichDomain(hostname string) (bool, error) {
+	slog.Debug("syncImmichDomain()", "hostname", hostname)
+	immichConfig, err := getImmichConfig()
+	if err != nil {
+		return false, err
+	}
+
+	domain := "http://" + hostname + ".local"
+	current := immichConfig.Server.ExternalDomain
+	if current == domain || (current != "" && !mdnsDomainRe.MatchString(current)) {
+		return false, nil
+	}
+	immichConfig.Server.ExternalDomain = domain
+
+	if err := writeImmichConfig(immichConfig); err != nil {
+		return false, err
+	}
+
+	slog.Info("Immich external domain updated", "domain", domain)
+	return true, nil
+}
+
+// detectInterfaces lists the wired interfaces in dir (normally /sys/class/net). Virtual interfaces (lo,
+// docker, tailscale, bridges) have no device link, and Wi-Fi needs more than an address to set up.
+func detectInterfaces(dir string) ([]string, error) {
+	slog.Debug("detectInterfaces()", "dir", dir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		slog.Debug("Error reading network interfaces", "err", err)
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if _, err := os.Stat(filepath.Join(path, "device")); err != nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(path, "wireless")); err == nil {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// mergeDetectedInterfaces adds the detected interfaces that don't have a static address as DHCP
+// entries, so every interface shows up in the form
+func mergeDetectedInterfaces(config *NixConfig, detected []string) {
+	known := map[string]bool{}
+	for i := range config.Interfaces {
+		known[config.Interfaces[i].Name] = true
+	}
+	for i, iface := range config.Interfaces {
+		for _, name := range detected {
+			if iface.Name == name {
+				config.Interfaces[i].Detected = true
+			}
+		}
+	}
+	for _, name := range detected {
+		if !known[name] {
+			config.Interfaces = append(config.Interfaces, NetworkInterface{Name: name, Detected: true})
+		}
+	}
+	sort.Slice(config.Interfaces, func(i, j int) bool {
+		return config.Interfaces[i].Name < config.Interfaces[j].Name
+	})
+}
+
+// loadInterfaces reads back the profiles networking.nix writes for static interfaces
+func loadInterfaces(l *settingLoader, config *NixConfig) error {
+	profiles, ok := l.Optional("Interfaces", "networking.networkmanager.ensureProfiles.profiles").(*NixAttrSet)
+	if !ok {
+		return nil
+	}
+	for _, binding := range profiles.Bindings {
+		profile, ok := nixUnwrapAttrs(binding.Value).(*NixAttrSet)
+		if !ok {
+			continue
+		}
+		str := func(path ...string) string {
+			node := nixLookupPath(profile, path)
+			if node == nil {
+				return ""
+			}
+			value, _ := nixStringValue(node)
+			return value
+		}
+
+		iface := NetworkInterface{Name: str("connection", "interface-name"), Static: true}
+		if iface.Name == "" {
+			continue
+		}
+		if str("ipv4", "method") == "manual" {
+			iface.IPv4Address, iface.IPv4Gateway, _ = strings.Cut(str("ipv4", "address1"), ",")
+		}
+		if str("ipv6", "method") == "manual" {
+			iface.IPv6Address, iface.IPv6Gateway, _ = strings.Cut(str("ipv6", "address1"), ",")
+		}
+		for _, dns := range []string{str("ipv4", "dns"), str("ipv6", "dns")} {
+			for _, server := range strings.Split(dns, ";") {
+				if server != "" {
+					iface.DNS = append(iface.DNS, server)
+				}
+			}
+		}
+		config.Interfaces = append(config.Interfaces, iface)
+	}
+	return nil
+}
+
+// parseInterfaceForm reads the per-interface fields of the admin form. Each interface posts its name
+// in "interface" and its settings in fields prefixed with iface-<name>-.
+func parseInterfaceForm(r *http.Request) []NetworkInterface {
+	var interfaces []NetworkInterface
+	for _, name := range r.Form["interface"] {
+		field := func(key string) string {
+			return strings.TrimSpace(r.FormValue("iface-" + name + "-" + key))
+		}
+		iface := NetworkInterface{
+			Name:        name,
+			Static:      field("mode") == "static",
+			IPv4Address: field("ipv4"),
+			IPv4Gateway: field("gateway4"),
+			IPv6Address: field("ipv6"),
+			IPv6Gateway: field("gateway6"),
+			DNS:         strings.FieldsFunc(field("dns"), func(r rune) bool { return r == ',' || r == ' ' }),
+		}
+		interfaces = append(interfaces, iface)
+	}
+	return interfaces
+}
+
+// validateInterfaces checks the address formats of every static interface
+func validateInterfaces(interfaces []NetworkInterface) error {
+	var errs []error
+	for _, iface := range interfaces {
+		if !interfaceNameRe.MatchString(iface.Name) {
+			errs = append(errs, fmt.Errorf("%q is not a valid interface name", iface.Name))
+			continue
+		}
+		if !iface.Static {
+			continue
+		}
+		if iface.IPv4Address == "" && iface.IPv6Address == "" {
+			errs = append(errs, fmt.Errorf("%s: a static interface needs an IPv4 or IPv6 address", iface.Name))
+		}
+		if err := validateAddress(iface.IPv4Address, iface.IPv4Gateway, true); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", iface.Name, err))
+		}
+		if err := validateAddress(iface.IPv6Address, iface.IPv6Gateway, false); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", iface.Name, err))
+		}
+		for _, server := range iface.DNS {
+			if _, err := netip.ParseAddr(server); err != nil {
+				errs = append(errs, fmt.Errorf("%s: DNS server %q is not an IP address", iface.Name, server))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateAddress checks an address in CIDR notation and a gateway on the same network. Either may be
+// empty, but a gateway needs an address.
+func validateAddress(cidr string, gateway string, v4 bool) error {
+	family, example := "IPv6", "fd00::10/64"
+	if v4 {
+		family, example = "IPv4", "192.168.1.10/24"
+	}
+	if cidr == "" {
+		if gateway != "" {
+			return fmt.Errorf("%s gateway set without an %s address", family, family)
+		}
+		return nil
+	}
+
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil || prefix.Addr().Is4() != v4 || prefix.Addr().Zone() != "" {
+		return fmt.Errorf("%q is not an %s address with a prefix length, e.g. %s", cidr, family, example)
+	}
+	if gateway == "" {
+		return nil
+	}
+	gw, err := netip.ParseAddr(gateway)
+	if err != nil || gw.Is4() != v4 {
+		return fmt.Errorf("%q is not an %s gateway address", gateway, family)
+	}
+	if !prefix.Masked().Contains(gw) {
+		return fmt.Errorf("gateway %s is not on the %s network", gateway, prefix.Masked())
+	}
+	return nil
+}
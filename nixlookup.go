@@ -0,0 +1,284 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// NixFile is a parsed Nix module along with the path it was read from
+type NixFile struct {
+	Path string
+	Root NixNode
+}
+
+// SettingSource records where a value shown in the UI was read from
+type SettingSource struct {
+	File string
+	Line int
+}
+
+func (s SettingSource) String() string {
+	if s.File == "" {
+		return "" // optional setting that isn't set
+	}
+	return fmt.Sprintf("%s line %d", filepath.Base(s.File), s.Line)
+}
+
+func parseNixFile(path string) (*NixFile, error) {
+	slog.Debug("parseNixFile()", "path", path)
+	src, err := os.ReadFile(path)
+	if err != nil {
+		slog.Debug("Error opening file:", "err", err)
+		return nil, err
+	}
+
+	root, err := parseNix(path, src)
+	if err != nil {
+		slog.Debug("Error parsing nix file", "path", path, "err", err)
+		return nil, err
+	}
+
+	return &NixFile{Path: path, Root: root}, nil
+}
+
+// nixImports returns the paths listed in a module's `imports`, resolved relative to the module
+func nixImports(file *NixFile) []string {
+	list, ok := nixLookup(file.Root, "imports").(*NixList)
+	if !ok {
+		return nil
+	}
+
+	var paths []string
+	for _, elem := range list.Elems {
+		path, ok := elem.(*NixPath)
+		if !ok || strings.HasPrefix(path.Value, "<") || strings.HasPrefix(path.Value, "~") {
+			continue
+		}
+		if filepath.IsAbs(path.Value) {
+			paths = append(paths, path.Value)
+		} else {
+			paths = append(paths, filepath.Join(filepath.Dir(file.Path), path.Value))
+		}
+	}
+	return paths
+}
+
+// lookupSetting finds the first module that defines an option and returns its value and location
+func lookupSetting(files []*NixFile, option string) (NixNode, SettingSource, error) {
+	slog.Debug("lookupSetting", "option", option)
+	for _, file := range files {
+		if value := nixLookup(file.Root, option); value != nil {
+			return value, SettingSource{File: file.Path, Line: value.Pos().Line}, nil
+		}
+	}
+	slog.Debug("No Match Found", "option", option)
+	return nil, SettingSource{}, fmt.Errorf("%s not found", option)
+}
+
+// nixLookup returns the value bound to a dotted option path such as "system.autoUpgrade.enable" in a
+// NixOS module, or nil. Nested sets are followed so `system.autoUpgrade = { enable = true; };` and
+// `system.autoUpgrade.enable = true;` both resolve. Modules that put their settings under `config`
+// are handled as well.
+func nixLookup(module NixNode, option string) NixNode {
+	set := nixModuleAttrs(module)
+	if set == nil {
+		return nil
+	}
+	path := strings.Split(option, ".")
+	if value := nixLookupPath(set, path); value != nil {
+		return value
+	}
+	if config, ok := nixUnwrapAttrs(nixLookupPath(set, []string{"config"})).(*NixAttrSet); ok {
+		return nixLookupPath(config, path)
+	}
+	return nil
+}
+
+// nixLookupPath follows path through set. Bindings that go deeper than the path, like
+// `users.users.alice = { ... };` when looking up users.users, are gathered into an attribute set of
+// their own, merged with any set bound to the path itself.
+func nixLookupPath(set *NixAttrSet, path []string) NixNode {
+	if set == nil {
+		return nil
+	}
+	var value NixNode
+	var deeper []*NixBinding
+	for _, binding := range set.Bindings {
+		names, ok := binding.staticPath()
+		if !ok {
+			continue
+		}
+		match := true
+		for i := range min(len(names), len(path)) {
+			if names[i] != path[i] {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		switch {
+		case len(names) > len(path):
+			deeper = append(deeper, &NixBinding{nixNode: binding.nixNode, Path: binding.Path[len(path):], Value: binding.Value})
+		case len(names) == len(path):
+			if value == nil {
+				value = binding.Value
+			}
+		default:
+			if nested, ok := nixUnwrapAttrs(binding.Value).(*NixAttrSet); ok && value == nil {
+				value = nixLookupPath(nested, path[len(names):])
+			}
+		}
+	}
+	if len(deeper) == 0 {
+		return value
+	}
+	merged := &NixAttrSet{nixNode: nixNode{At: deeper[0].Pos()}, Bindings: deeper}
+	if nested, ok := nixUnwrapAttrs(value).(*NixAttrSet); ok {
+		merged.At = nested.Pos()
+		merged.Bindings = slices.Concat(nested.Bindings, deeper)
+		merged.Inherits = nested.Inherits
+	} else if value != nil {
+		return value
+	}
+	return merged
+}
+
+// nixModuleAttrs digs the top-level attribute set out of a module, skipping the
+// `{ config, pkgs, ... }:` header and any surrounding with/let/assert
+func nixModuleAttrs(node NixNode) *NixAttrSet {
+	for {
+		switch n := node.(type) {
+		case *NixLambda:
+			node = n.Body
+		case *NixAttrSet:
+			return n
+		default:
+			next := nixUnwrapAttrs(node)
+			if next == node {
+				return nil
+			}
+			node = next
+		}
+	}
+}
+
+// nixUnwrapAttrs strips the wrappers that commonly surround an attribute set value
+func nixUnwrapAttrs(node NixNode) NixNode {
+	for {
+		switch n := node.(type) {
+		case *NixWith:
+			node = n.Body
+		case *NixLet:
+			node = n.Body
+		case *NixAssert:
+			node = n.Body
+		default:
+			return nixUnwrapModifiers(node)
+		}
+	}
+}
+
+// nixUnwrapModifiers strips lib.mkDefault, lib.mkForce and friends from a value. Priorities aren't
+// evaluated, the wrapped value is what gets displayed.
+func nixUnwrapModifiers(node NixNode) NixNode {
+	for {
+		apply, ok := node.(*NixApply)
+		if !ok {
+			return node
+		}
+		name := ""
+		switch fn := apply.Func.(type) {
+		case *NixIdent:
+			name = fn.Name
+		case *NixSelect:
+			if len(fn.Path) > 0 {
+				name = fn.Path[len(fn.Path)-1].Name
+			}
+		case *NixApply: // lib.mkOverride 50 value
+			if sel, ok := fn.Func.(*NixSelect); ok && len(sel.Path) > 0 && sel.Path[len(sel.Path)-1].Name == "mkOverride" {
+				node = apply.Arg
+				continue
+			}
+		}
+		switch name {
+		case "mkDefault", "mkForce", "mkOptionDefault", "mkImageMediaOverride":
+			node = apply.Arg
+		default:
+			return node
+		}
+	}
+}
+
+func nixBoolValue(node NixNode) (bool, error) {
+	ident, ok := nixUnwrapModifiers(node).(*NixIdent)
+	if !ok || (ident.Name != "true" && ident.Name != "false") {
+		return false, fmt.Errorf("%s: expected true or false", node.Pos())
+	}
+	return ident.Name == "true", nil
+}
+
+func nixIntList(node NixNode) ([]int, error) {
+	list, ok := nixUnwrapModifiers(node).(*NixList)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a list", node.Pos())
+	}
+	var values []int
+	for _, elem := range list.Elems {
+		n, ok := nixUnwrapModifiers(elem).(*NixInt)
+		if !ok {
+			return nil, fmt.Errorf("%s: expected an integer", elem.Pos())
+		}
+		values = append(values, int(n.Value))
+	}
+	return values, nil
+}
+
+func nixStringList(node NixNode) ([]string, error) {
+	list, ok := nixUnwrapModifiers(node).(*NixList)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a list", node.Pos())
+	}
+	var values []string
+	for _, elem := range list.Elems {
+		value, err := nixStringValue(elem)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+func nixStringValue(node NixNode) (string, error) {
+	str, ok := nixUnwrapModifiers(node).(*NixString)
+	if !ok {
+		return "", fmt.Errorf("%s: expected a string", node.Pos())
+	}
+	text, ok := nixStaticString(str)
+	if !ok {
+		return "", fmt.Errorf("%s: string contains interpolation", node.Pos())
+	}
+	return text, nil
+}
+
+// nixStringText returns the literal text of a string with any ${...} interpolations dropped.
+// Used for scripts where the value we're after sits in the literal portion.
+func nixStringText(node NixNode) (string, error) {
+	str, ok := nixUnwrapAttrs(node).(*NixString)
+	if !ok {
+		return "", fmt.Errorf("%s: expected a string", node.Pos())
+	}
+	var b strings.Builder
+	for _, part := range str.Parts {
+		if lit, ok := part.(*NixStringLiteral); ok {
+			b.WriteString(lit.Text)
+		}
+	}
+	return b.String(), nil
+}
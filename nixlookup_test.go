@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestNixLookup(t *testing.T) {
+	tests := []struct {
+		src    string
+		option string
+		want   string
+	}{
+		// Nested and dotted bindings
+		{`{ system = { autoUpgrade = { enable = true; }; }; }`, "system.autoUpgrade.enable", `true`},
+		{`{ system.autoUpgrade.enable = true; }`, "system.autoUpgrade.enable", `true`},
+		{`{ system.autoUpgrade = { enable = true; }; }`, "system.autoUpgrade.enable", `true`},
+		{`{ system = { autoUpgrade.enable = true; }; }`, "system.autoUpgrade.enable", `true`},
+		{`{ system.stateVersion = "24.11"; system.autoUpgrade.enable = true; }`, "system.autoUpgrade.enable", `true`},
+		{`{ a.b = 1; }`, "a.c", `<nil>`},
+		{`{ a.b = 1; }`, "a.b.c", `<nil>`},
+		{`{ ${x} = 1; a = 2; }`, "a", `2`},
+
+		// Bindings that go deeper than the lookup are gathered into a set
+		{`{ users.users.alice = { isNormalUser = true; }; users.users.bob.uid = 1001; }`, "users.users", `{alice = {isNormalUser = true;}; bob.uid = 1001;}`},
+		{`{ users.users.alice = { isNormalUser = true; }; users.users.bob.uid = 1001; }`, "users.users.bob", `{uid = 1001;}`},
+		{`{ users = { users.alice.uid = 1000; }; }`, "users.users", `{alice.uid = 1000;}`},
+		{`{ users.users = { alice.uid = 1000; }; users.users.bob.uid = 1001; }`, "users.users", `{alice.uid = 1000; bob.uid = 1001;}`},
+		{`{ users.mutableUsers = false; users.users.alice.uid = 1000; }`, "users", `{mutableUsers = false; users.alice.uid = 1000;}`},
+
+		// Module headers, wrappers and the config attribute
+		{`{ config, pkgs, ... }: { networking.hostName = "immich"; }`, "networking.hostName", `"immich"`},
+		{`{ config, ... }: { options = { }; config = { networking.hostName = "immich"; }; }`, "networking.hostName", `"immich"`},
+		{`{ config, ... }: { config.networking.hostName = "immich"; }`, "networking.hostName", `"immich"`},
+		{`{ pkgs, ... }: with pkgs; { a = let b = 1; in { c = b; }; }`, "a.c", `b`},
+
+		// mkDefault and mkForce are looked through, on sets and on the value returned
+		{`{ services.openssh = lib.mkDefault { enable = true; }; }`, "services.openssh.enable", `true`},
+		{`{ services.openssh.enable = lib.mkDefault true; }`, "services.openssh.enable", `true`},
+		{`{ networking.hostName = lib.mkForce "immich"; }`, "networking.hostName", `"immich"`},
+		{`{ time.timeZone = lib.mkOverride 50 "UTC"; }`, "time.timeZone", `"UTC"`},
+		{`{ networking.hostName = lib.mkIf true "immich"; }`, "networking.hostName", `(((. lib mkIf) true) "immich")`},
+	}
+	for _, test := range tests {
+		root, err := parseNix("test.nix", []byte(test.src))
+		if err != nil {
+			t.Fatalf("parseNix(%q): %v", test.src, err)
+		}
+		if got := nixSexpr(nixUnwrapModifiers(nixLookup(root, test.option))); got != test.want {
+			t.Errorf("nixLookup(%q, %s) = %s, want %s", test.src, test.option, got, test.want)
+		}
+	}
+}
+
+// Settings gathered from deeper bindings point at the first of them
+func TestLookupSettingDeeperBindings(t *testing.T) {
+	root, err := parseNix("users.nix", []byte("{\n  users.mutableUsers = false;\n  users.users.alice.uid = 1000;\n}\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, source, err := lookupSetting([]*NixFile{{Path: "users.nix", Root: root}}, "users.users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.String() != "users.nix line 3" {
+		t.Errorf("source = %s, want users.nix line 3", source)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// The NixOS config is split into modules that each own a slice of the settings. configuration.nix imports
+// them and, like admin.nix, is never written by this program.
+//
+// Each module moves through the same files as the old single config did:
+//   system.tmp  - rendered on save, waiting to be validated and applied
+//   system.nix  - live
+//   system.old  - previous live version, restored on rollback
+//
+// A module that is switched off for the saved config gets an empty .tmp, which removes the live file on apply.
+
+type SystemSettings struct {
+	Flake         bool // build from flake.nix with a pinned flake.lock instead of channels
+	TimeZone      string
+	AutoUpgrade   bool   //also applies to allowReboot
+	UpgradeTime   string //systemd calendar expression for system.autoUpgrade.dates, e.g. "02:00" or "Sun 02:00"
+	UpgradeDelay  string //randomizedDelaySec, a systemd time span
+	UpgradeWindow int    //minutes a reboot is allowed for, starting 30min after the scheduled time
+	UpgradeLower  string //value derived from UpgradeTime+30min
+	UpgradeUpper  string //value derived from UpgradeLower+UpgradeWindow
+	Locale        string // i18n.defaultLocale, the language
+	Formats       string // every LC_* in i18n.extraLocaleSettings (dates, numbers, units...)
+	Keymap        string // xkb layout, also used for the console
+	NixGC         bool   // nix.gc.automatic
+	NixGCDates    string // systemd calendar expression for nix.gc.dates
+	NixGCDays     int    // generations older than this many days are collected
+}
+
+type NetworkingSettings struct {
+	Hostname   string             // also the mDNS name, the server is reachable at <Hostname>.local
+	Interfaces []NetworkInterface // only static ones are written, the rest are left to NetworkManager's DHCP
+	Firewall
+}
+
+type ZFSSettings struct {
+	HostID    string           // networking.hostId, 8 hex digits. Must not change once a pool is imported.
+	Snapshots []SnapshotPolicy // services.sanoid.datasets
+}
+
+type RemoteAccessSettings struct {
+	Tailscale bool
+	TSAuthkey string
+}
+
+type NixModule struct {
+	Name       string                                          // file name in nixDir and in internal/templates/nixos
+	Settings   func(config *NixConfig) any                     // the settings struct the template is rendered with, nil if it has none
+	Load       func(l *settingLoader, config *NixConfig) error // reads the module's settings back out of the file
+	Enabled    func(config *NixConfig) bool                    // nil means the module is always written
+	Stage      func(config *NixConfig, tmpPath string) error   // writes the .tmp for files that aren't templates
+	Check      func(config *NixConfig) error                   // refuses settings that would break the running system
+	Standalone bool                                            // not imported by configuration.nix
+}
+
+var nixModules = []NixModule{
+	{
+		Name:     "system.nix",
+		Settings: func(config *NixConfig) any { return config.SystemSettings },
+		Load: func(l *settingLoader, config *NixConfig) error {
+			config.TimeZone = "UTC" // time.timeZone defaults to null, which is UTC
+			if err := l.String("TimeZone", "time.timeZone", &config.TimeZone); err != nil {
+				return err
+			}
+			if err := l.Bool("AutoUpgrade", "system.autoUpgrade.enable", &config.AutoUpgrade); err != nil {
+				return err
+			}
+			config.Flake = l.Optional("Flake", "system.autoUpgrade.flake") != nil
+			if err := loadUpgradeSchedule(l, config); err != nil {
+				return err
+			}
+			if err := loadNixGC(l, config); err != nil {
+				return err
+			}
+			// Older system.nix files left these to configuration.nix
+			config.Locale, config.Formats, config.Keymap = defaultLocale, defaultLocale, defaultKeymap
+			optional := []struct {
+				field, option string
+				dst           *string
+			}{
+				{"Locale", "i18n.defaultLocale", &config.Locale},
+				{"Formats", "i18n.extraLocaleSettings.LC_TIME", &config.Formats},
+				{"Keymap", "services.xserver.xkb.layout", &config.Keymap},
+			}
+			for _, o := range optional {
+				if node := l.Optional(o.field, o.option); node != nil {
+					value, err := nixStringValue(node)
+					if err != nil {
+						return err
+					}
+					*o.dst = value
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Name:     "zfs.nix",
+		Settings: func(config *NixConfig) any { return config.ZFSSettings },
+		Load: func(l *settingLoader, config *NixConfig) error {
+			config.HostID = ""
+			if node := l.Optional("HostID", "networking.hostId"); node != nil {
+				id, err := nixStringValue(node)
+				if err != nil {
+					return err
+				}
+				config.HostID = id
+			}
+			return loadSnapshots(l, config)
+		},
+		Check: checkHostID,
+	},
+	{
+		Name:     "networking.nix",
+		Settings: func(config *NixConfig) any { return config.NetworkingSettings },
+		Load: func(l *settingLoader, config *NixConfig) error {
+			config.Hostname = "nixos"
+			if err := l.String("Hostname", "networking.hostName", &config.Hostname); err != nil {
+				return err
+			}
+			if err := loadFirewall(l, config); err != nil {
+				return err
+			}
+			return loadInterfaces(l, config)
+		},
+	},
+	{
+		// Nothing in immich.nix is edited from the panel, the template is written out as it is
+		Name: "immich.nix",
+	},
+	{
+		Name:     "users.nix",
+		Settings: func(config *NixConfig) any { return config.UserSettings },
+		Load:     loadUsers,
+	},
+	{
+		Name:     "ssh.nix",
+		Settings: func(config *NixConfig) any { return config.SSHSettings },
+		Load:     loadSSH,
+		Check:    checkSSHUser,
+	},
+	{
+		Name:     "remoteaccess.nix",
+		Settings: func(config *NixConfig) any { return config.RemoteAccessSettings },
+		Load: func(l *settingLoader, config *NixConfig) error {
+			if err := l.Bool("Tailscale", "services.tailscale.enable", &config.Tailscale); err != nil {
+				return err
+			}
+			config.TSAuthkey = ""
+			script := l.Optional("TSAuthkey", "systemd.services.tailscale-autoconnect.script")
+			if script == nil {
+				return nil
+			}
+			scriptText, err := nixStringText(script)
+			if err != nil {
+				slog.Debug("Error reading Tailscale autoconnect script", "err", err)
+				return err
+			}
+			// A script with a placeholder instead of a key leaves the field empty to be filled in
+			if key, err := parseAuthKeySetting(scriptText); err == nil {
+				config.TSAuthkey = key
+			}
+			return nil
+		},
+	},
+	{
+		Name:       "flake.nix",
+		Settings:   func(config *NixConfig) any { return config.SystemSettings },
+		Enabled:    func(config *NixConfig) bool { return config.Flake },
+		Standalone: true,
+	},
+	{
+		Name:       "flake.lock", // must come after flake.nix, it's locked from the saved flake
+		Enabled:    func(config *NixConfig) bool { return config.Flake },
+		Stage:      stageFlakeLock,
+		Standalone: true,
+	},
+}
+
+// Path returns where the module lives in dir with the given extension (".nix", ".tmp" or ".old"). ".nix"
+// is always the live file, so flake.lock stays flake.lock and is staged as flake.lock.tmp.
+func (m NixModule) Path(dir string, ext string) string {
+	if ext == ".nix" {
+		return filepath.Join(dir, m.Name)
+	}
+	return filepath.Join(dir, strings.TrimSuffix(m.Name, ".nix")+ext)
+}
+
+func (m NixModule) enabled(config *NixConfig) bool {
+	return m.Enabled == nil || m.Enabled(config)
+}
+
+// settingLoader looks settings up in one module and records where each was found. Installs from before
+// the config was split into modules still have their settings in configuration.nix, so that is searched
+// for anything the module doesn't set.
+type settingLoader struct {
+	file     *NixFile
+	fallback *NixFile // configuration.nix, nil if it couldn't be read
+	sources  map[string]SettingSource
+}
+
+// Optional returns a setting, or nil if neither the module nor configuration.nix sets it
+func (l *settingLoader) Optional(field string, option string) NixNode {
+	files := []*NixFile{l.file}
+	if l.fallback != nil {
+		files = append(files, l.fallback)
+	}
+	node, source, err := lookupSetting(files, option)
+	if err != nil {
+		return nil
+	}
+	l.sources[field] = source
+	return node
+}
+
+// String, Bool and Ints read a setting into dst. A setting nothing sets leaves dst as it is, so the
+// loaders put NixOS's default there first.
+func (l *settingLoader) String(field string, option string, dst *string) error {
+	node := l.Optional(field, option)
+	if node == nil {
+		return nil
+	}
+	value, err := nixStringValue(node)
+	if err != nil {
+		return err
+	}
+	*dst = value
+	return nil
+}
+
+func (l *settingLoader) Bool(field string, option string, dst *bool) error {
+	node := l.Optional(field, option)
+	if node == nil {
+		return nil
+	}
+	value, err := nixBoolValue(node)
+	if err != nil {
+		return err
+	}
+	*dst = value
+	return nil
+}
+
+func (l *settingLoader) Ints(field string, option string, dst *[]int) error {
+	node := l.Optional(field, option)
+	if node == nil {
+		return nil
+	}
+	value, err := nixIntList(node)
+	if err != nil {
+		return err
+	}
+	*dst = value
+	return nil
+}
+
+// loadNixConfig reads every module's settings from dir. ext picks the live (".nix") or saved (".tmp") files.
+// A module or setting that doesn't exist yet is read from configuration.nix, or else gets NixOS's default.
+func loadNixConfig(dir string, ext string) (*NixConfig, error) {
+	slog.Debug("loadNixConfig()", "dir", dir, "ext", ext)
+	config := NixConfig{Sources: map[string]SettingSource{}}
+	fallback, err := parseNixFile(filepath.Join(dir, "configuration.nix"))
+	if err != nil {
+		slog.Debug("Not falling back to configuration.nix", "err", err)
+		fallback = nil
+	}
+	for _, module := range nixModules {
+		if module.Load == nil {
+			continue
+		}
+		path := module.Path(dir, ext)
+		file, err := parseNixFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			// Not written yet, the module's settings come from configuration.nix or the defaults
+			// until the next apply creates it
+			slog.Info("Module does not exist yet", "module", module.Name)
+			file, err = &NixFile{Path: path, Root: &NixAttrSet{}}, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		l := &settingLoader{file: file, fallback: fallback, sources: config.Sources}
+		if err := module.Load(l, &config); err != nil {
+			return nil, err
+		}
+	}
+	return &config, nil
+}
+
+// saveTmpFile renders every module template into its .tmp file
+func saveTmpFile(config *NixConfig) error {
+	slog.Debug("saveTmpFile()")
+	for _, module := range nixModules {
+		if module.Check == nil || !module.enabled(config) {
+			continue
+		}
+		if err := module.Check(config); err != nil {
+			return err
+		}
+	}
+
+	for _, module := range nixModules {
+		tmpPath := module.Path(nixDir, ".tmp")
+		if !module.enabled(config) {
+			if err := os.WriteFile(tmpPath, nil, 0644); err != nil {
+				slog.Debug("| Error clearing .tmp file |", "module", module.Name, "err", err)
+				return err
+			}
+			continue
+		}
+		if module.Stage != nil {
+			if err := module.Stage(config, tmpPath); err != nil {
+				slog.Debug("| Error staging module |", "module", module.Name, "err", err)
+				return err
+			}
+			continue
+		}
+
+		tmpl, err := texttemplate.ParseFS(templates, "internal/templates/nixos/"+module.Name)
+		if err != nil {
+			slog.Debug("| Error rendering template |", "module", module.Name, "err", err)
+			return err
+		}
+
+		outFile, err := os.Create(tmpPath)
+		if err != nil {
+			slog.Debug("| Error creating .tmp file |", "err", err)
+			return err
+		}
+
+		var settings any
+		if module.Settings != nil {
+			settings = module.Settings(config)
+		}
+		err = tmpl.Execute(outFile, settings)
+		outFile.Close()
+		if err != nil {
+			slog.Debug("| Error writing .tmp file |", "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// isRemoved reports whether a staged .tmp is empty, meaning the module is off in the saved config
+func isRemoved(tmpPath string) (bool, error) {
+	info, err := os.Stat(tmpPath)
+	if err != nil {
+		return false, err
+	}
+	return info.Size() == 0, nil
+}
+
+// hasSavedConfig reports whether every module has a .tmp waiting to be applied
+func hasSavedConfig() bool {
+	for _, module := range nixModules {
+		if _, err := os.Stat(module.Path(nixDir, ".tmp")); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// loadBaseConfig loads the config an edit starts from: the saved one if there is one, otherwise the live one
+func loadBaseConfig() (*NixConfig, error) {
+	slog.Debug("loadBaseConfig()")
+	ext := ".nix"
+	if hasSavedConfig() {
+		ext = ".tmp"
+	}
+	config, err := loadNixConfig(nixDir, ext)
+	if err != nil {
+		return nil, err
+	}
+	config.UpgradeLower, config.UpgradeUpper, err = getLowerUpper(config.UpgradeTime, config.UpgradeWindow)
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureHostID(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func switchConfig() error {
+	slog.Debug("switchConfig()")
+	for _, module := range nixModules {
+		configPath := module.Path(nixDir, ".nix")
+		backupPath := module.Path(nixDir, ".old")
+		tmpPath := module.Path(nixDir, ".tmp")
+
+		slog.Info("Backing up module...", "module", module.Name)
+		err := CopyFile(configPath, backupPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			// New module. No .old tells restoreConfig to remove it again
+			if err := os.Remove(backupPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		} else if err != nil {
+			slog.Debug("Error backing up config file", "err", err)
+			return err
+		}
+
+		removed, err := isRemoved(tmpPath)
+		if err != nil {
+			return err
+		}
+		if removed {
+			slog.Info("Removing module that is off in the saved version...", "module", module.Name)
+			if err := os.Remove(configPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+
+		slog.Info("Replacing module with saved version...", "module", module.Name)
+		if err := CopyFile(tmpPath, configPath); err != nil {
+			slog.Debug("Error replacing config file", "err", err)
+			return err
+		}
+	}
+
+	slog.Info("Configuration file swtich complete.")
+	return nil
+}
+
+// restoreModules puts every module's .old back in place
+func restoreModules() error {
+	slog.Debug("restoreModules()")
+	for _, module := range nixModules {
+		configPath := module.Path(nixDir, ".nix")
+		err := CopyFile(module.Path(nixDir, ".old"), configPath)
+		if errors.Is(err, fs.ErrNotExist) {
+			slog.Info("Module did not exist before, removing it", "module", module.Name)
+			if err := os.Remove(configPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			slog.Debug("Error restoring config file", "err", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// checkModuleImports makes sure configuration.nix in dir imports every managed module and that admin.nix
+// doesn't override them, otherwise the settings in that module would silently have no effect
+func checkModuleImports(dir string) error {
+	file, err := parseNixFile(filepath.Join(dir, "configuration.nix"))
+	if err != nil {
+		return err
+	}
+	imported := map[string]bool{}
+	for _, path := range nixImports(file) {
+		imported[filepath.Clean(path)] = true
+	}
+
+	var missing []string
+	for _, module := range nixModules {
+		if module.Standalone {
+			continue
+		}
+		if !imported[filepath.Clean(module.Path(dir, ".nix"))] {
+			missing = append(missing, "./"+module.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("configuration.nix does not import %s", strings.Join(missing, ", "))
+	}
+	return checkAdminOverrides(dir)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadNixConfigExample(t *testing.T) {
+	config, err := loadNixConfig("example/etc/nixos", ".nix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Hostname != "immich-dev-vm" || config.UpgradeTime != "02:00" || !config.AutoUpgrade {
+		t.Errorf("settings from the modules weren't read: %+v", config)
+	}
+	if len(config.Users) != 1 || config.Users[0].Name != "admin" || !config.SSH {
+		t.Errorf("users.nix and ssh.nix weren't read: %+v", config)
+	}
+	if config.TimeZone != "UTC" {
+		t.Errorf("settings nothing sets should have NixOS's defaults: %+v", config)
+	}
+}
+
+// An install from before the modules only has configuration.nix
+func TestLoadNixConfigSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	src := `{ config, pkgs, ... }:
+{
+  networking.hostName = "photos";
+  time.timeZone = "Europe/Amsterdam";
+  services.openssh.enable = true;
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "configuration.nix"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadNixConfig(dir, ".nix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Hostname != "photos" || config.TimeZone != "Europe/Amsterdam" || !config.SSH {
+		t.Errorf("settings weren't read from configuration.nix: %+v", config)
+	}
+	if source := config.Sources["TimeZone"].String(); source != "configuration.nix line 4" {
+		t.Errorf("TimeZone source = %q", source)
+	}
+	if config.UpgradeTime != "04:40" || config.AutoUpgrade {
+		t.Errorf("upgrade schedule should have NixOS's defaults: %+v", config)
+	}
+}
+
+// The installer writes users as dotted bindings in configuration.nix, next to system accounts
+func TestLoadNixConfigInstallerUsers(t *testing.T) {
+	dir := t.TempDir()
+	src := `{ config, pkgs, ... }:
+{
+  users.users.alice = {
+    isNormalUser = true;
+    description = "Alice";
+    extraGroups = [ "networkmanager" "wheel" ];
+  };
+  users.users.bob.isNormalUser = true;
+  users.users.bob.openssh.authorizedKeys.keys = [ "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIGVTRQZWpy1vsmo2Z0wvuU6dpPr8oHWFeOMJrBbJPkF3 bob@laptop" ];
+  users.users.root.openssh.authorizedKeys.keys = [ ];
+  users.users.backup = { isSystemUser = true; group = "backup"; };
+}
+`
+	if err := os.WriteFile(filepath.Join(dir, "configuration.nix"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := loadNixConfig(dir, ".nix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Users) != 2 {
+		t.Fatalf("Users = %+v, want alice and bob", config.Users)
+	}
+	alice, bob := config.Users[0], config.Users[1]
+	if alice.Name != "alice" || alice.Description != "Alice" || !alice.Admin {
+		t.Errorf("alice = %+v", alice)
+	}
+	if bob.Name != "bob" || bob.Admin || len(bob.AuthorizedKeys) != 1 {
+		t.Errorf("bob = %+v", bob)
+	}
+	if err := validateUsers(config.Users); err != nil {
+		t.Errorf("installer users should be valid: %v", err)
+	}
+}
+
+// immich.nix has no settings, saving writes the template out unchanged
+func TestSaveStaticModule(t *testing.T) {
+	stageSavedConfig(t)
+	saved, err := os.ReadFile(filepath.Join(nixDir, "immich.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := templates.ReadFile("internal/templates/nixos/immich.nix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(saved) != string(template) {
+		t.Errorf("immich.tmp differs from its template:\n%s", saved)
+	}
+}
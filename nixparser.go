@@ -0,0 +1,1086 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Nix expression parser. It only needs to understand the language well enough to read values
+// back out of the config files, so it builds an AST with positions but never evaluates anything.
+// Grammar and operator precedence follow the Nix manual (https://nix.dev/manual/nix/stable/language/operators).
+
+type NixPos struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p NixPos) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+type NixNode interface {
+	Pos() NixPos
+}
+
+type nixNode struct {
+	At NixPos
+}
+
+func (n nixNode) Pos() NixPos { return n.At }
+
+type NixIdent struct {
+	nixNode
+	Name string
+}
+
+type NixInt struct {
+	nixNode
+	Value int64
+}
+
+type NixFloat struct {
+	nixNode
+	Value float64
+}
+
+// NixString holds both "double quoted" and indented strings. Parts are either *NixStringLiteral
+// or the expression inside a ${...} interpolation.
+type NixString struct {
+	nixNode
+	Indented bool
+	Parts    []NixNode
+}
+
+type NixStringLiteral struct {
+	nixNode
+	Text string
+}
+
+// NixPath covers ./relative, /absolute, ~/home and <search> paths. Value is the path as written.
+type NixPath struct {
+	nixNode
+	Value string
+}
+
+type NixURI struct {
+	nixNode
+	Value string
+}
+
+type NixList struct {
+	nixNode
+	Elems []NixNode
+}
+
+type NixAttrSet struct {
+	nixNode
+	Rec      bool
+	Bindings []*NixBinding
+	Inherits []*NixInherit
+}
+
+// NixAttrName is one element of an attribute path. Name is set for static names (including
+// "quoted" ones without interpolation), Dynamic for ${...} names.
+type NixAttrName struct {
+	At      NixPos
+	Name    string
+	Dynamic NixNode
+}
+
+type NixBinding struct {
+	nixNode
+	Path  []NixAttrName
+	Value NixNode
+}
+
+type NixInherit struct {
+	nixNode
+	From  NixNode
+	Names []NixAttrName
+}
+
+type NixLet struct {
+	nixNode
+	Bindings []*NixBinding
+	Inherits []*NixInherit
+	Body     NixNode
+}
+
+type NixWith struct {
+	nixNode
+	Scope NixNode
+	Body  NixNode
+}
+
+type NixAssert struct {
+	nixNode
+	Cond NixNode
+	Body NixNode
+}
+
+type NixIf struct {
+	nixNode
+	Cond NixNode
+	Then NixNode
+	Else NixNode
+}
+
+type NixFormal struct {
+	Name    string
+	Default NixNode
+}
+
+// NixLambda is either `arg: body` or `{ formals, ... } @ arg: body`
+type NixLambda struct {
+	nixNode
+	Arg        string
+	HasFormals bool
+	Formals    []NixFormal
+	Ellipsis   bool
+	Body       NixNode
+}
+
+type NixApply struct {
+	nixNode
+	Func NixNode
+	Arg  NixNode
+}
+
+type NixSelect struct {
+	nixNode
+	Expr    NixNode
+	Path    []NixAttrName
+	Default NixNode
+}
+
+type NixHasAttr struct {
+	nixNode
+	Expr NixNode
+	Path []NixAttrName
+}
+
+type NixBinary struct {
+	nixNode
+	Op    string
+	Left  NixNode
+	Right NixNode
+}
+
+type NixUnary struct {
+	nixNode
+	Op      string
+	Operand NixNode
+}
+
+// staticPath returns the attribute names of a binding, or false if any of them is dynamic
+func (b *NixBinding) staticPath() ([]string, bool) {
+	names := make([]string, len(b.Path))
+	for i, n := range b.Path {
+		if n.Dynamic != nil {
+			return nil, false
+		}
+		names[i] = n.Name
+	}
+	return names, true
+}
+
+// ====== LEXER ======
+
+type nixTokenKind int
+
+const (
+	tokEOF nixTokenKind = iota
+	tokID
+	tokKeyword
+	tokInt
+	tokFloat
+	tokPath
+	tokURI
+	tokStrOpen     // "
+	tokStrClose    // "
+	tokIndOpen     // ''
+	tokIndClose    // ''
+	tokStrText     // literal text inside a string, already unescaped
+	tokInterpOpen  // ${
+	tokInterpClose // } closing an interpolation
+	tokPunct       // operators and punctuation
+)
+
+type nixToken struct {
+	Kind nixTokenKind
+	Text string
+	Pos  NixPos
+}
+
+var nixKeywords = map[string]bool{
+	"if": true, "then": true, "else": true, "assert": true, "with": true,
+	"let": true, "in": true, "rec": true, "inherit": true, "or": true,
+}
+
+// Token patterns lifted from the flex rules in the Nix source (src/libexpr/lexer.l)
+var (
+	nixIDRe    = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_'\-]*`)
+	nixIntRe   = regexp.MustCompile(`^[0-9]+`)
+	nixFloatRe = regexp.MustCompile(`^(([1-9][0-9]*\.[0-9]*)|(0?\.[0-9]+))([Ee][+-]?[0-9]+)?`)
+	nixPathRe  = regexp.MustCompile(`^[a-zA-Z0-9._\-+]*(/[a-zA-Z0-9._\-+]+)+/?`)
+	nixHPathRe = regexp.MustCompile(`^~(/[a-zA-Z0-9._\-+]+)+/?`)
+	nixSPathRe = regexp.MustCompile(`^<[a-zA-Z0-9._\-+]+(/[a-zA-Z0-9._\-+]+)*>`)
+	nixURIRe   = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+\-.]*:[a-zA-Z0-9%/?:@&=+$,\-_.!~*']+`)
+)
+
+var nixOperators = []string{
+	"...", "==", "!=", "<=", ">=", "&&", "||", "->", "//", "++",
+	"{", "}", "[", "]", "(", ")", ";", ":", ",", ".", "@", "=", "?",
+	"<", ">", "+", "-", "*", "/", "!",
+}
+
+const (
+	lexExpr = iota
+	lexString
+	lexIndString
+)
+
+type nixLexMode struct {
+	kind   int
+	braces int    // open { in this expression, so we know which } closes an interpolation
+	open   NixPos // where a string started, for reporting it unterminated
+}
+
+type nixLexer struct {
+	file   string
+	src    string
+	off    int
+	line   int
+	col    int
+	modes  []nixLexMode
+	tokens []nixToken
+}
+
+func lexNix(file string, src []byte) ([]nixToken, error) {
+	l := &nixLexer{file: file, src: string(src), line: 1, col: 1, modes: []nixLexMode{{kind: lexExpr}}}
+	for {
+		var err error
+		switch l.modes[len(l.modes)-1].kind {
+		case lexString:
+			err = l.lexString()
+		case lexIndString:
+			err = l.lexIndString()
+		default:
+			var done bool
+			done, err = l.lexExprToken()
+			if done {
+				return l.tokens, nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (l *nixLexer) pos() NixPos {
+	return NixPos{File: l.file, Line: l.line, Col: l.col}
+}
+
+func (l *nixLexer) advance(n int) {
+	for _, c := range l.src[l.off : l.off+n] {
+		if c == '\n' {
+			l.line++
+			l.col = 1
+		} else {
+			l.col++
+		}
+	}
+	l.off += n
+}
+
+func (l *nixLexer) emit(kind nixTokenKind, text string, pos NixPos) {
+	l.tokens = append(l.tokens, nixToken{Kind: kind, Text: text, Pos: pos})
+}
+
+func (l *nixLexer) errorf(format string, args ...any) error {
+	return fmt.Errorf("%s: %s", l.pos(), fmt.Sprintf(format, args...))
+}
+
+func (l *nixLexer) skipSpaceAndComments() error {
+	for l.off < len(l.src) {
+		rest := l.src[l.off:]
+		switch {
+		case rest[0] == ' ' || rest[0] == '\t' || rest[0] == '\r' || rest[0] == '\n':
+			l.advance(1)
+		case rest[0] == '#':
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			l.advance(end)
+		case strings.HasPrefix(rest, "/*"):
+			end := strings.Index(rest[2:], "*/")
+			if end < 0 {
+				return l.errorf("unterminated comment")
+			}
+			l.advance(end + 4)
+		default:
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *nixLexer) lexExprToken() (bool, error) {
+	if err := l.skipSpaceAndComments(); err != nil {
+		return false, err
+	}
+	mode := &l.modes[len(l.modes)-1]
+	pos := l.pos()
+
+	if l.off >= len(l.src) {
+		if len(l.modes) > 1 {
+			return false, l.errorf("unexpected end of file inside interpolation")
+		}
+		l.emit(tokEOF, "", pos)
+		return true, nil
+	}
+
+	rest := l.src[l.off:]
+	switch {
+	case rest[0] == '"':
+		l.advance(1)
+		l.emit(tokStrOpen, `"`, pos)
+		l.modes = append(l.modes, nixLexMode{kind: lexString, open: pos})
+		return false, nil
+	case strings.HasPrefix(rest, "''"):
+		l.advance(2)
+		l.emit(tokIndOpen, "''", pos)
+		l.modes = append(l.modes, nixLexMode{kind: lexIndString, open: pos})
+		return false, nil
+	case strings.HasPrefix(rest, "${"):
+		l.advance(2)
+		l.emit(tokInterpOpen, "${", pos)
+		l.modes = append(l.modes, nixLexMode{kind: lexExpr})
+		return false, nil
+	case rest[0] == '{':
+		mode.braces++
+	case rest[0] == '}':
+		if mode.braces == 0 && len(l.modes) > 1 {
+			l.advance(1)
+			l.emit(tokInterpClose, "}", pos)
+			l.modes = l.modes[:len(l.modes)-1]
+			return false, nil
+		}
+		mode.braces--
+	}
+
+	// Longest match wins, earlier rules win ties (same as flex)
+	best, kind := 0, tokEOF
+	try := func(re *regexp.Regexp, k nixTokenKind) {
+		if m := re.FindStringIndex(rest); m != nil && m[1] > best {
+			best, kind = m[1], k
+		}
+	}
+	try(nixIDRe, tokID)
+	try(nixIntRe, tokInt)
+	try(nixFloatRe, tokFloat)
+	try(nixPathRe, tokPath)
+	try(nixHPathRe, tokPath)
+	try(nixSPathRe, tokPath)
+	try(nixURIRe, tokURI)
+
+	if best > 0 {
+		text := rest[:best]
+		if kind == tokID && nixKeywords[text] {
+			kind = tokKeyword
+		}
+		l.advance(best)
+		l.emit(kind, text, pos)
+		return false, nil
+	}
+
+	for _, op := range nixOperators {
+		if strings.HasPrefix(rest, op) {
+			l.advance(len(op))
+			l.emit(tokPunct, op, pos)
+			return false, nil
+		}
+	}
+
+	return false, l.errorf("unexpected character %q", rest[0])
+}
+
+func unescapeNixChar(c byte) string {
+	switch c {
+	case 'n':
+		return "\n"
+	case 'r':
+		return "\r"
+	case 't':
+		return "\t"
+	}
+	return string(c)
+}
+
+func (l *nixLexer) lexString() error {
+	var text strings.Builder
+	pos := l.pos()
+	flush := func() {
+		if text.Len() > 0 {
+			l.emit(tokStrText, text.String(), pos)
+			text.Reset()
+		}
+	}
+
+	for l.off < len(l.src) {
+		rest := l.src[l.off:]
+		switch {
+		case rest[0] == '"':
+			flush()
+			l.emit(tokStrClose, `"`, l.pos())
+			l.advance(1)
+			l.modes = l.modes[:len(l.modes)-1]
+			return nil
+		case strings.HasPrefix(rest, "${"):
+			flush()
+			l.emit(tokInterpOpen, "${", l.pos())
+			l.advance(2)
+			l.modes = append(l.modes, nixLexMode{kind: lexExpr})
+			return nil
+		case strings.HasPrefix(rest, "$$"):
+			text.WriteString("$$")
+			l.advance(2)
+		case rest[0] == '\\' && len(rest) > 1:
+			text.WriteString(unescapeNixChar(rest[1]))
+			l.advance(2)
+		default:
+			text.WriteByte(rest[0])
+			l.advance(1)
+		}
+	}
+	return fmt.Errorf("%s: unterminated string", l.modes[len(l.modes)-1].open)
+}
+
+func (l *nixLexer) lexIndString() error {
+	var text strings.Builder
+	pos := l.pos()
+	flush := func() {
+		if text.Len() > 0 {
+			l.emit(tokStrText, text.String(), pos)
+			text.Reset()
+		}
+	}
+
+	for l.off < len(l.src) {
+		rest := l.src[l.off:]
+		switch {
+		case strings.HasPrefix(rest, "'''"):
+			text.WriteString("''")
+			l.advance(3)
+		case strings.HasPrefix(rest, "''$"):
+			text.WriteString("$")
+			l.advance(3)
+		case strings.HasPrefix(rest, `''\`) && len(rest) > 3:
+			text.WriteString(unescapeNixChar(rest[3]))
+			l.advance(4)
+		case strings.HasPrefix(rest, "''"):
+			flush()
+			l.emit(tokIndClose, "''", l.pos())
+			l.advance(2)
+			l.modes = l.modes[:len(l.modes)-1]
+			return nil
+		case strings.HasPrefix(rest, "${"):
+			flush()
+			l.emit(tokInterpOpen, "${", l.pos())
+			l.advance(2)
+			l.modes = append(l.modes, nixLexMode{kind: lexExpr})
+			return nil
+		case strings.HasPrefix(rest, "$$"):
+			text.WriteString("$$")
+			l.advance(2)
+		default:
+			text.WriteByte(rest[0])
+			l.advance(1)
+		}
+	}
+	return fmt.Errorf("%s: unterminated indented string", l.modes[len(l.modes)-1].open)
+}
+
+// ====== PARSER ======
+
+type nixParser struct {
+	toks []nixToken
+	pos  int
+}
+
+// nixParseError is used to unwind out of the recursive descent, see parseNix
+type nixParseError struct {
+	err error
+}
+
+// parseNix parses a complete Nix file. file is only used for positions and error messages.
+func parseNix(file string, src []byte) (node NixNode, err error) {
+	toks, err := lexNix(file, src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &nixParser{toks: toks}
+	defer func() {
+		if r := recover(); r != nil {
+			perr, ok := r.(nixParseError)
+			if !ok {
+				panic(r)
+			}
+			node, err = nil, perr.err
+		}
+	}()
+
+	node = p.parseExpr()
+	if tok := p.peek(); tok.Kind != tokEOF {
+		p.fail(tok, "expected end of file")
+	}
+	return node, nil
+}
+
+func (p *nixParser) peek() nixToken {
+	return p.peekAt(0)
+}
+
+func (p *nixParser) peekAt(n int) nixToken {
+	if p.pos+n >= len(p.toks) {
+		return p.toks[len(p.toks)-1] // always tokEOF
+	}
+	return p.toks[p.pos+n]
+}
+
+func (p *nixParser) next() nixToken {
+	tok := p.peek()
+	if p.pos < len(p.toks)-1 {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *nixParser) isPunct(text string) bool {
+	tok := p.peek()
+	return tok.Kind == tokPunct && tok.Text == text
+}
+
+func (p *nixParser) isKeyword(text string) bool {
+	tok := p.peek()
+	return tok.Kind == tokKeyword && tok.Text == text
+}
+
+func (p *nixParser) fail(tok nixToken, msg string) {
+	found := tok.Text
+	if tok.Kind == tokEOF {
+		found = "end of file"
+	}
+	panic(nixParseError{fmt.Errorf("%s: %s, found %q", tok.Pos, msg, found)})
+}
+
+func (p *nixParser) expectPunct(text string) nixToken {
+	if !p.isPunct(text) {
+		p.fail(p.peek(), fmt.Sprintf("expected %q", text))
+	}
+	return p.next()
+}
+
+func (p *nixParser) expectKeyword(text string) nixToken {
+	if !p.isKeyword(text) {
+		p.fail(p.peek(), fmt.Sprintf("expected %q", text))
+	}
+	return p.next()
+}
+
+func (p *nixParser) parseExpr() NixNode {
+	tok := p.peek()
+	switch {
+	case tok.Kind == tokID && p.peekAt(1).Kind == tokPunct && p.peekAt(1).Text == ":":
+		p.next()
+		p.next()
+		return &NixLambda{nixNode: nixNode{tok.Pos}, Arg: tok.Text, Body: p.parseExpr()}
+	case tok.Kind == tokID && p.peekAt(1).Kind == tokPunct && p.peekAt(1).Text == "@":
+		p.next()
+		p.next()
+		lambda := p.parseFormals()
+		lambda.At = tok.Pos
+		lambda.Arg = tok.Text
+		p.expectPunct(":")
+		lambda.Body = p.parseExpr()
+		return lambda
+	case tok.Kind == tokPunct && tok.Text == "{" && p.looksLikeFormals():
+		lambda := p.parseFormals()
+		if p.isPunct("@") {
+			p.next()
+			arg := p.next()
+			if arg.Kind != tokID {
+				p.fail(arg, "expected identifier after @")
+			}
+			lambda.Arg = arg.Text
+		}
+		p.expectPunct(":")
+		lambda.Body = p.parseExpr()
+		return lambda
+	case tok.Kind == tokKeyword && tok.Text == "assert":
+		p.next()
+		cond := p.parseExpr()
+		p.expectPunct(";")
+		return &NixAssert{nixNode: nixNode{tok.Pos}, Cond: cond, Body: p.parseExpr()}
+	case tok.Kind == tokKeyword && tok.Text == "with":
+		p.next()
+		scope := p.parseExpr()
+		p.expectPunct(";")
+		return &NixWith{nixNode: nixNode{tok.Pos}, Scope: scope, Body: p.parseExpr()}
+	case tok.Kind == tokKeyword && tok.Text == "let" && !(p.peekAt(1).Kind == tokPunct && p.peekAt(1).Text == "{"):
+		p.next()
+		let := &NixLet{nixNode: nixNode{tok.Pos}}
+		let.Bindings, let.Inherits = p.parseBindings(func() bool { return p.isKeyword("in") })
+		p.expectKeyword("in")
+		let.Body = p.parseExpr()
+		return let
+	case tok.Kind == tokKeyword && tok.Text == "if":
+		p.next()
+		n := &NixIf{nixNode: nixNode{tok.Pos}}
+		n.Cond = p.parseExpr()
+		p.expectKeyword("then")
+		n.Then = p.parseExpr()
+		p.expectKeyword("else")
+		n.Else = p.parseExpr()
+		return n
+	}
+	return p.parseImpl()
+}
+
+// looksLikeFormals decides whether the { at the current position opens a lambda's formal
+// arguments or an attribute set. Formals are `{ }:`, `{ } @`, `{ a, ...`, `{ a ? ...` or `{ a }`.
+func (p *nixParser) looksLikeFormals() bool {
+	first := p.peekAt(1)
+	if first.Kind == tokPunct && first.Text == "}" {
+		after := p.peekAt(2)
+		return after.Kind == tokPunct && (after.Text == ":" || after.Text == "@")
+	}
+	if first.Kind == tokPunct && first.Text == "..." {
+		return true
+	}
+	if first.Kind != tokID {
+		return false
+	}
+	second := p.peekAt(2)
+	return second.Kind == tokPunct && (second.Text == "," || second.Text == "?" || second.Text == "}")
+}
+
+func (p *nixParser) parseFormals() *NixLambda {
+	open := p.expectPunct("{")
+	lambda := &NixLambda{nixNode: nixNode{open.Pos}, HasFormals: true}
+	for !p.isPunct("}") {
+		if p.isPunct("...") {
+			p.next()
+			lambda.Ellipsis = true
+		} else {
+			name := p.next()
+			if name.Kind != tokID {
+				p.fail(name, "expected formal argument name")
+			}
+			formal := NixFormal{Name: name.Text}
+			if p.isPunct("?") {
+				p.next()
+				formal.Default = p.parseExpr()
+			}
+			lambda.Formals = append(lambda.Formals, formal)
+		}
+		if !p.isPunct(",") {
+			break
+		}
+		p.next()
+	}
+	p.expectPunct("}")
+	return lambda
+}
+
+// Binary operators from loosest to tightest. The unary ! sits between // and +.
+func (p *nixParser) parseImpl() NixNode {
+	left := p.parseOr()
+	if p.isPunct("->") {
+		op := p.next()
+		return &NixBinary{nixNode: nixNode{op.Pos}, Op: op.Text, Left: left, Right: p.parseImpl()}
+	}
+	return left
+}
+
+func (p *nixParser) parseLeftAssoc(next func() NixNode, ops ...string) NixNode {
+	left := next()
+	for {
+		matched := false
+		for _, op := range ops {
+			if p.isPunct(op) {
+				tok := p.next()
+				left = &NixBinary{nixNode: nixNode{tok.Pos}, Op: op, Left: left, Right: next()}
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return left
+		}
+	}
+}
+
+func (p *nixParser) parseNonAssoc(next func() NixNode, ops ...string) NixNode {
+	left := next()
+	for _, op := range ops {
+		if p.isPunct(op) {
+			tok := p.next()
+			return &NixBinary{nixNode: nixNode{tok.Pos}, Op: op, Left: left, Right: next()}
+		}
+	}
+	return left
+}
+
+func (p *nixParser) parseOr() NixNode {
+	return p.parseLeftAssoc(p.parseAnd, "||")
+}
+
+func (p *nixParser) parseAnd() NixNode {
+	return p.parseLeftAssoc(p.parseEquality, "&&")
+}
+
+func (p *nixParser) parseEquality() NixNode {
+	return p.parseNonAssoc(p.parseComparison, "==", "!=")
+}
+
+func (p *nixParser) parseComparison() NixNode {
+	return p.parseNonAssoc(p.parseUpdate, "<=", ">=", "<", ">")
+}
+
+func (p *nixParser) parseUpdate() NixNode {
+	left := p.parseNot()
+	if p.isPunct("//") {
+		op := p.next()
+		return &NixBinary{nixNode: nixNode{op.Pos}, Op: op.Text, Left: left, Right: p.parseUpdate()}
+	}
+	return left
+}
+
+func (p *nixParser) parseNot() NixNode {
+	if p.isPunct("!") {
+		op := p.next()
+		return &NixUnary{nixNode: nixNode{op.Pos}, Op: "!", Operand: p.parseNot()}
+	}
+	return p.parseAdditive()
+}
+
+func (p *nixParser) parseAdditive() NixNode {
+	return p.parseLeftAssoc(p.parseMultiplicative, "+", "-")
+}
+
+func (p *nixParser) parseMultiplicative() NixNode {
+	return p.parseLeftAssoc(p.parseConcat, "*", "/")
+}
+
+func (p *nixParser) parseConcat() NixNode {
+	left := p.parseHasAttr()
+	if p.isPunct("++") {
+		op := p.next()
+		return &NixBinary{nixNode: nixNode{op.Pos}, Op: op.Text, Left: left, Right: p.parseConcat()}
+	}
+	return left
+}
+
+func (p *nixParser) parseHasAttr() NixNode {
+	left := p.parseNegate()
+	for p.isPunct("?") {
+		op := p.next()
+		left = &NixHasAttr{nixNode: nixNode{op.Pos}, Expr: left, Path: p.parseAttrPath()}
+	}
+	return left
+}
+
+func (p *nixParser) parseNegate() NixNode {
+	if p.isPunct("-") {
+		op := p.next()
+		return &NixUnary{nixNode: nixNode{op.Pos}, Op: "-", Operand: p.parseNegate()}
+	}
+	return p.parseApply()
+}
+
+func (p *nixParser) parseApply() NixNode {
+	fn := p.parseSelect()
+	for p.startsSimple() {
+		arg := p.parseSelect()
+		fn = &NixApply{nixNode: nixNode{fn.Pos()}, Func: fn, Arg: arg}
+	}
+	return fn
+}
+
+// startsSimple reports whether the next token can begin an argument in a function application
+func (p *nixParser) startsSimple() bool {
+	tok := p.peek()
+	switch tok.Kind {
+	case tokID, tokInt, tokFloat, tokPath, tokURI, tokStrOpen, tokIndOpen:
+		return true
+	case tokKeyword:
+		return tok.Text == "rec" || tok.Text == "let"
+	case tokPunct:
+		return tok.Text == "(" || tok.Text == "{" || tok.Text == "["
+	}
+	return false
+}
+
+func (p *nixParser) parseSelect() NixNode {
+	expr := p.parseSimple()
+	if !p.isPunct(".") {
+		return expr
+	}
+	p.next()
+	sel := &NixSelect{nixNode: nixNode{expr.Pos()}, Expr: expr, Path: p.parseAttrPath()}
+	if p.isKeyword("or") {
+		p.next()
+		sel.Default = p.parseSelect()
+	}
+	return sel
+}
+
+func (p *nixParser) parseSimple() NixNode {
+	tok := p.peek()
+	switch tok.Kind {
+	case tokID:
+		p.next()
+		return &NixIdent{nixNode: nixNode{tok.Pos}, Name: tok.Text}
+	case tokInt:
+		p.next()
+		v, err := strconv.ParseInt(tok.Text, 10, 64)
+		if err != nil {
+			p.fail(tok, "invalid integer")
+		}
+		return &NixInt{nixNode: nixNode{tok.Pos}, Value: v}
+	case tokFloat:
+		p.next()
+		v, err := strconv.ParseFloat(tok.Text, 64)
+		if err != nil {
+			p.fail(tok, "invalid float")
+		}
+		return &NixFloat{nixNode: nixNode{tok.Pos}, Value: v}
+	case tokPath:
+		p.next()
+		return &NixPath{nixNode: nixNode{tok.Pos}, Value: tok.Text}
+	case tokURI:
+		p.next()
+		return &NixURI{nixNode: nixNode{tok.Pos}, Value: tok.Text}
+	case tokStrOpen, tokIndOpen:
+		return p.parseString()
+	case tokKeyword:
+		switch tok.Text {
+		case "rec":
+			p.next()
+			set := p.parseAttrSet()
+			set.At = tok.Pos
+			set.Rec = true
+			return set
+		case "let": // legacy `let { ... }`
+			p.next()
+			set := p.parseAttrSet()
+			set.At = tok.Pos
+			set.Rec = true
+			return &NixSelect{nixNode: nixNode{tok.Pos}, Expr: set, Path: []NixAttrName{{At: tok.Pos, Name: "body"}}}
+		}
+	case tokPunct:
+		switch tok.Text {
+		case "(":
+			p.next()
+			expr := p.parseExpr()
+			p.expectPunct(")")
+			return expr
+		case "{":
+			return p.parseAttrSet()
+		case "[":
+			p.next()
+			list := &NixList{nixNode: nixNode{tok.Pos}}
+			for !p.isPunct("]") {
+				if p.peek().Kind == tokEOF {
+					p.fail(p.peek(), `expected "]"`)
+				}
+				list.Elems = append(list.Elems, p.parseSelect())
+			}
+			p.next()
+			return list
+		}
+	}
+	p.fail(tok, "unexpected token")
+	return nil
+}
+
+func (p *nixParser) parseString() NixNode {
+	open := p.next()
+	str := &NixString{nixNode: nixNode{open.Pos}, Indented: open.Kind == tokIndOpen}
+	for {
+		tok := p.next()
+		switch tok.Kind {
+		case tokStrText:
+			str.Parts = append(str.Parts, &NixStringLiteral{nixNode: nixNode{tok.Pos}, Text: tok.Text})
+		case tokInterpOpen:
+			str.Parts = append(str.Parts, p.parseExpr())
+			if p.peek().Kind != tokInterpClose {
+				p.fail(p.peek(), `expected "}"`)
+			}
+			p.next()
+		case tokStrClose, tokIndClose:
+			if str.Indented {
+				stripIndentation(str)
+			}
+			return str
+		default:
+			p.fail(tok, "unexpected token in string")
+		}
+	}
+}
+
+// stripIndentation removes the common leading whitespace from an indented string the same way
+// Nix does: the shortest indentation of any non-blank line is removed from every line, and the
+// first line is dropped if it only contains whitespace.
+func stripIndentation(str *NixString) {
+	minIndent := -1
+	atLineStart, indent := true, 0
+	for _, part := range str.Parts {
+		lit, ok := part.(*NixStringLiteral)
+		if !ok {
+			if atLineStart && (minIndent < 0 || indent < minIndent) {
+				minIndent = indent
+			}
+			atLineStart = false
+			continue
+		}
+		for _, c := range lit.Text {
+			switch {
+			case c == '\n':
+				atLineStart, indent = true, 0
+			case atLineStart && c == ' ':
+				indent++
+			case atLineStart:
+				if minIndent < 0 || indent < minIndent {
+					minIndent = indent
+				}
+				atLineStart = false
+			}
+		}
+	}
+	if minIndent < 0 {
+		minIndent = 0
+	}
+
+	atLineStart, indent = true, 0
+	for i, part := range str.Parts {
+		lit, ok := part.(*NixStringLiteral)
+		if !ok {
+			atLineStart = false
+			continue
+		}
+		var b strings.Builder
+		for _, c := range lit.Text {
+			switch {
+			case c == '\n':
+				atLineStart, indent = true, 0
+				b.WriteRune(c)
+			case atLineStart && c == ' ' && indent < minIndent:
+				indent++
+			default:
+				atLineStart = false
+				b.WriteRune(c)
+			}
+		}
+		lit.Text = b.String()
+		if i == 0 {
+			if nl := strings.IndexByte(lit.Text, '\n'); nl >= 0 && strings.TrimLeft(lit.Text[:nl], " \t") == "" {
+				lit.Text = lit.Text[nl+1:]
+			}
+		}
+	}
+}
+
+func (p *nixParser) parseAttrSet() *NixAttrSet {
+	open := p.expectPunct("{")
+	set := &NixAttrSet{nixNode: nixNode{open.Pos}}
+	set.Bindings, set.Inherits = p.parseBindings(func() bool { return p.isPunct("}") })
+	p.expectPunct("}")
+	return set
+}
+
+func (p *nixParser) parseBindings(done func() bool) ([]*NixBinding, []*NixInherit) {
+	var bindings []*NixBinding
+	var inherits []*NixInherit
+	for !done() {
+		tok := p.peek()
+		if tok.Kind == tokEOF {
+			p.fail(tok, "unexpected end of file in attribute set")
+		}
+		if tok.Kind == tokKeyword && tok.Text == "inherit" {
+			p.next()
+			inh := &NixInherit{nixNode: nixNode{tok.Pos}}
+			if p.isPunct("(") {
+				p.next()
+				inh.From = p.parseExpr()
+				p.expectPunct(")")
+			}
+			for !p.isPunct(";") {
+				inh.Names = append(inh.Names, p.parseAttrName())
+			}
+			p.next()
+			inherits = append(inherits, inh)
+			continue
+		}
+		binding := &NixBinding{nixNode: nixNode{tok.Pos}, Path: p.parseAttrPath()}
+		p.expectPunct("=")
+		binding.Value = p.parseExpr()
+		p.expectPunct(";")
+		bindings = append(bindings, binding)
+	}
+	return bindings, inherits
+}
+
+func (p *nixParser) parseAttrPath() []NixAttrName {
+	path := []NixAttrName{p.parseAttrName()}
+	for p.isPunct(".") {
+		p.next()
+		path = append(path, p.parseAttrName())
+	}
+	return path
+}
+
+func (p *nixParser) parseAttrName() NixAttrName {
+	tok := p.peek()
+	switch {
+	case tok.Kind == tokID || (tok.Kind == tokKeyword && tok.Text == "or"):
+		p.next()
+		return NixAttrName{At: tok.Pos, Name: tok.Text}
+	case tok.Kind == tokStrOpen:
+		str := p.parseString().(*NixString)
+		if text, ok := nixStaticString(str); ok {
+			return NixAttrName{At: tok.Pos, Name: text}
+		}
+		return NixAttrName{At: tok.Pos, Dynamic: str}
+	case tok.Kind == tokInterpOpen:
+		p.next()
+		expr := p.parseExpr()
+		if p.peek().Kind != tokInterpClose {
+			p.fail(p.peek(), `expected "}"`)
+		}
+		p.next()
+		return NixAttrName{At: tok.Pos, Dynamic: expr}
+	}
+	p.fail(tok, "expected attribute name")
+	return NixAttrName{}
+}
+
+// nixStaticString returns the text of a string without interpolations
+func nixStaticString(str *NixString) (string, bool) {
+	var b strings.Builder
+	for _, part := range str.Parts {
+		lit, ok := part.(*NixStringLiteral)
+		if !ok {
+			return "", false
+		}
+		b.WriteString(lit.Text)
+	}
+	return b.String(), true
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// nixSexpr prints an AST compactly so tests can compare whole trees
+func nixSexpr(node NixNode) string {
+	switch n := node.(type) {
+	case nil:
+		return "<nil>"
+	case *NixIdent:
+		return n.Name
+	case *NixInt:
+		return fmt.Sprint(n.Value)
+	case *NixFloat:
+		return fmt.Sprint(n.Value)
+	case *NixPath:
+		return n.Value
+	case *NixURI:
+		return n.Value
+	case *NixString:
+		if text, ok := nixStaticString(n); ok {
+			return fmt.Sprintf("%q", text)
+		}
+		parts := []string{"str"}
+		for _, part := range n.Parts {
+			if lit, ok := part.(*NixStringLiteral); ok {
+				parts = append(parts, fmt.Sprintf("%q", lit.Text))
+			} else {
+				parts = append(parts, nixSexpr(part))
+			}
+		}
+		return "(" + strings.Join(parts, " ") + ")"
+	case *NixList:
+		var elems []string
+		for _, elem := range n.Elems {
+			elems = append(elems, nixSexpr(elem))
+		}
+		return "[" + strings.Join(elems, " ") + "]"
+	case *NixAttrSet:
+		set := "{" + nixBindingsSexpr(n.Bindings, n.Inherits) + "}"
+		if n.Rec {
+			return "rec " + set
+		}
+		return set
+	case *NixLet:
+		return "(let " + nixBindingsSexpr(n.Bindings, n.Inherits) + " in " + nixSexpr(n.Body) + ")"
+	case *NixWith:
+		return "(with " + nixSexpr(n.Scope) + "; " + nixSexpr(n.Body) + ")"
+	case *NixAssert:
+		return "(assert " + nixSexpr(n.Cond) + "; " + nixSexpr(n.Body) + ")"
+	case *NixIf:
+		return "(if " + nixSexpr(n.Cond) + " " + nixSexpr(n.Then) + " " + nixSexpr(n.Else) + ")"
+	case *NixLambda:
+		arg := n.Arg
+		if n.HasFormals {
+			var formals []string
+			for _, formal := range n.Formals {
+				if formal.Default != nil {
+					formals = append(formals, formal.Name+" ? "+nixSexpr(formal.Default))
+				} else {
+					formals = append(formals, formal.Name)
+				}
+			}
+			if n.Ellipsis {
+				formals = append(formals, "...")
+			}
+			arg = "{" + strings.Join(formals, ", ") + "}"
+			if n.Arg != "" {
+				arg += "@" + n.Arg
+			}
+		}
+		return "(" + arg + ": " + nixSexpr(n.Body) + ")"
+	case *NixApply:
+		return "(" + nixSexpr(n.Func) + " " + nixSexpr(n.Arg) + ")"
+	case *NixSelect:
+		sel := "(. " + nixSexpr(n.Expr) + " " + nixAttrPathSexpr(n.Path)
+		if n.Default != nil {
+			sel += " or " + nixSexpr(n.Default)
+		}
+		return sel + ")"
+	case *NixHasAttr:
+		return "(? " + nixSexpr(n.Expr) + " " + nixAttrPathSexpr(n.Path) + ")"
+	case *NixBinary:
+		return "(" + n.Op + " " + nixSexpr(n.Left) + " " + nixSexpr(n.Right) + ")"
+	case *NixUnary:
+		return "(" + n.Op + " " + nixSexpr(n.Operand) + ")"
+	}
+	return fmt.Sprintf("<%T>", node)
+}
+
+func nixBindingsSexpr(bindings []*NixBinding, inherits []*NixInherit) string {
+	var parts []string
+	for _, binding := range bindings {
+		parts = append(parts, nixAttrPathSexpr(binding.Path)+" = "+nixSexpr(binding.Value)+";")
+	}
+	for _, inherit := range inherits {
+		part := "inherit"
+		if inherit.From != nil {
+			part += " (" + nixSexpr(inherit.From) + ")"
+		}
+		parts = append(parts, part+" "+nixAttrPathSexpr(inherit.Names)+";")
+	}
+	return strings.Join(parts, " ")
+}
+
+func nixAttrPathSexpr(path []NixAttrName) string {
+	var names []string
+	for _, name := range path {
+		if name.Dynamic != nil {
+			names = append(names, "${"+nixSexpr(name.Dynamic)+"}")
+		} else {
+			names = append(names, name.Name)
+		}
+	}
+	return strings.Join(names, ".")
+}
+
+func TestParseNix(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		// Literals
+		{`[ 1 2.5 ./a.nix /etc/nixos <nixpkgs> ~/x https://example.com ]`, `[1 2.5 ./a.nix /etc/nixos <nixpkgs> ~/x https://example.com]`},
+		{`{ a.b = 1; "c d" = 2; inherit x; inherit (y) z; }`, `{a.b = 1; c d = 2; inherit x; inherit (y) z;}`},
+		{`rec { a = 1; }`, `rec {a = 1;}`},
+
+		// Strings and their escapes
+		{`"a\nb\t\"c\" \${x} $${y}"`, `"a\nb\t\"c\" ${x} $${y}"`},
+		{"''\n  foo\n    bar\n  ''", `"foo\n  bar\n"`},
+		{"''\n  a '''b''' ''${x} ''\\t\n''", `"a ''b'' ${x} \t\n"`},
+		{"''foo''", `"foo"`},
+		{"''\n\n  a\n\n  b\n''", `"\na\n\nb\n"`},
+
+		// Interpolation
+		{`"a${b}c"`, `(str "a" b "c")`},
+		{`"${a.b}"`, `(str (. a b))`},
+		{`"x${"y${z}"}"`, `(str "x" (str "y" z))`},
+		{`"${ { a = 1; }.a }"`, `(str (. {a = 1;} a))`},
+		{"''\n    x ${y}\n  z\n''", `(str "  x " y "\nz\n")`},
+		{`{ ${a} = 1; "${b}" = 2; }`, `{${a} = 1; ${(str b)} = 2;}`},
+
+		// Lambdas
+		{`x: y: x`, `(x: (y: x))`},
+		{`{ a, b ? 1, ... }: a`, `({a, b ? 1, ...}: a)`},
+		{`args@{ a }: a`, `({a}@args: a)`},
+		{`{ a }@args: a`, `({a}@args: a)`},
+		{`{ }: 1`, `({}: 1)`},
+		{`{ }`, `{}`},
+		{`{ a = 1; }`, `{a = 1;}`},
+		{`{ config, pkgs, ... }: { imports = [ ./a.nix ]; }`, `({config, pkgs, ...}: {imports = [./a.nix];})`},
+
+		// or
+		{`a.b or c`, `(. a b or c)`},
+		{`f a.b.c or d e`, `((f (. a b.c or d)) e)`},
+		{`{ or = 1; }.or`, `(. {or = 1;} or)`},
+
+		// Precedence, loosest to tightest: -> || && == < // ! + * ++ ? - apply
+		{`1 + 2 * 3`, `(+ 1 (* 2 3))`},
+		{`a - b - c`, `(- (- a b) c)`},
+		{`a ++ b ++ c`, `(++ a (++ b c))`},
+		{`a // b // c`, `(// a (// b c))`},
+		{`a -> b -> c`, `(-> a (-> b c))`},
+		{`!a && b || c`, `(|| (&& (! a) b) c)`},
+		{`a == b && c < d`, `(&& (== a b) (< c d))`},
+		{`a + b == c`, `(== (+ a b) c)`},
+		{`a ++ b + c`, `(+ (++ a b) c)`},
+		{`!a ? b`, `(! (? a b))`},
+		{`-f x`, `(- (f x))`},
+		{`f x.y ? z`, `(? (f (. x y)) z)`},
+		{`lib.mkIf cond { a = 1; } // b`, `(// (((. lib mkIf) cond) {a = 1;}) b)`},
+
+		// Keywords
+		{`let a = 1; inherit (b) c; in a`, `(let a = 1; inherit (b) c; in a)`},
+		{`with pkgs; [ git ]`, `(with pkgs; [git])`},
+		{`if a then b else c`, `(if a b c)`},
+		{`assert a; b`, `(assert a; b)`},
+		{"# comment\n/* block */ a", `a`},
+	}
+	for _, test := range tests {
+		node, err := parseNix("test.nix", []byte(test.src))
+		if err != nil {
+			t.Errorf("parseNix(%q): %v", test.src, err)
+			continue
+		}
+		if got := nixSexpr(node); got != test.want {
+			t.Errorf("parseNix(%q) = %s, want %s", test.src, got, test.want)
+		}
+	}
+}
+
+func TestParseNixErrors(t *testing.T) {
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{`{ a = 1 }`, `test.nix:1:9: expected ";", found "}"`},
+		{"{\n  a = ;\n}", `test.nix:2:7: unexpected token, found ";"`},
+		{`{ a = 1; }}`, `test.nix:1:11: expected end of file, found "}"`},
+		{`x:`, `test.nix:1:3: unexpected token, found "end of file"`},
+		{`[ 1 2`, `test.nix:1:6: expected "]", found "end of file"`},
+		{"\n  \"abc", `test.nix:2:3: unterminated string`},
+		{`''abc`, `test.nix:1:1: unterminated indented string`},
+		{`"${a"`, `test.nix:1:5: unterminated string`},
+		{`"a${b}c`, `test.nix:1:1: unterminated string`},
+		{`/* abc`, `test.nix:1:1: unterminated comment`},
+		{`{ a = 1; } $`, `test.nix:1:12: unexpected character '$'`},
+		{`{ a, 1 }: a`, `test.nix:1:6: expected formal argument name, found "1"`},
+	}
+	for _, test := range tests {
+		_, err := parseNix("test.nix", []byte(test.src))
+		if err == nil || err.Error() != test.want {
+			t.Errorf("parseNix(%q) error = %v, want %s", test.src, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// The Nix store lives on the boot drive and grows with every generation, update and rebuild. nix.gc
+// collects it on a schedule, these are for looking at it and collecting by hand.
+
+const nixStore = "/nix/store"
+
+// StoreUsage is the space on the filesystem holding the store. The store is usually most of it, and
+// a full boot drive is what breaks rebuilds, so that's what's shown rather than walking the store.
+type StoreUsage struct {
+	Size ByteSize
+	Free ByteSize
+}
+
+func (u StoreUsage) Used() ByteSize {
+	return u.Size - u.Free
+}
+
+func (u StoreUsage) Percent() int {
+	if u.Size == 0 {
+		return 0
+	}
+	return int(u.Used() * 100 / u.Size)
+}
+
+func storeUsage(path string) (*StoreUsage, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		slog.Debug("Error reading store filesystem", "path", path, "err", err)
+		return nil, err
+	}
+	return &StoreUsage{
+		Size: ByteSize(stat.Blocks * uint64(stat.Bsize)),
+		Free: ByteSize(stat.Bavail * uint64(stat.Bsize)),
+	}, nil
+}
+
+// ByteSize prints in binary units, e.g. "12.3 GiB"
+type ByteSize uint64
+
+func (n ByteSize) String() string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := ByteSize(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// nix.gc settings, rendered into system.nix
+const (
+	defaultGCDates = "weekly"
+	defaultGCDays  = 30
+)
+
+var gcOlderThanRe = regexp.MustCompile(`--delete-older-than (\d+)d`)
+
+// loadNixGC reads nix.gc. Older system.nix files don't set it, which is the same as it being off.
+func loadNixGC(l *settingLoader, config *NixConfig) error {
+	config.NixGC, config.NixGCDates, config.NixGCDays = false, defaultGCDates, defaultGCDays
+	if node := l.Optional("NixGC", "nix.gc.automatic"); node != nil {
+		enabled, err := nixBoolValue(node)
+		if err != nil {
+			return err
+		}
+		config.NixGC = enabled
+	}
+	if node := l.Optional("NixGCDates", "nix.gc.dates"); node != nil {
+		dates, err := nixStringValue(node)
+		if err != nil {
+			return err
+		}
+		config.NixGCDates = dates
+	}
+	if node := l.Optional("NixGCDays", "nix.gc.options"); node != nil {
+		options, err := nixStringValue(node)
+		if err != nil {
+			return err
+		}
+		if match := gcOlderThanRe.FindStringSubmatch(options); match != nil {
+			config.NixGCDays, _ = strconv.Atoi(match[1])
+		}
+	}
+	return nil
+}
+
+func validateNixGC(settings SystemSettings) error {
+	if _, err := parseCalendar(settings.NixGCDates); err != nil {
+		return fmt.Errorf("garbage collection schedule: %w", err)
+	}
+	if settings.NixGCDays < 1 {
+		return fmt.Errorf("garbage collection must keep at least a day of generations")
+	}
+	return nil
+}
+
+// collectGarbage deletes generations older than days and everything in the store they were keeping
+// alive, then refreshes the boot menu. It returns nix-collect-garbage's summary, e.g. "1234 store
+// paths deleted, 5678.90 MiB freed".
+func collectGarbage(days int) (string, error) {
+	slog.Debug("collectGarbage()", "days", days)
+	unlock, err := lockSystem()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	// The rollback of a pending apply needs the generation this could delete
+	if getPending() != nil {
+		return "", errPending
+	}
+	if days < 1 {
+		return "", fmt.Errorf("generations newer than a day are always kept")
+	}
+
+	out, err := runCommand(context.Background(), "/", "nix-collect-garbage", "--delete-older-than", strconv.Itoa(days)+"d")
+	if err != nil {
+		slog.Debug("| error running nix-collect-garbage |", "output", string(out), "err", err)
+		return "", fmt.Errorf("nix-collect-garbage failed: %w", err)
+	}
+	summary := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.Contains(line, "freed") {
+			summary = strings.TrimSpace(line)
+		}
+	}
+
+	// From the profile, not /run/current-system, so the boot default stays where the profile points
+	out, err = runCommand(context.Background(), "/", filepath.Join(systemProfile, "bin", "switch-to-configuration"), "boot")
+	if err != nil {
+		slog.Debug("| error refreshing boot entries |", "output", string(out), "err", err)
+		return summary, fmt.Errorf("switch-to-configuration failed: %w", err)
+	}
+
+	slog.Info("Nix store garbage collected", "days", days, "summary", summary)
+	return summary, nil
+}
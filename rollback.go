@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// After a config is applied it has to be confirmed from the web UI within confirmWindow, otherwise the
+// previous config is restored. If the new config breaks Caddy or the network the admin can't reach the
+// confirm button, so the box fixes itself.
+
+const confirmWindow = 2 * time.Minute
+const systemProfile = "/nix/var/nix/profiles/system"
+
+// PendingApply is persisted next to the config so a restart of this service during activation
+// doesn't skip the rollback
+type PendingApply struct {
+	Deadline       time.Time `json:"deadline"`
+	PrevGeneration string    `json:"prevGeneration"` // profile link the system was on before the switch
+	Revision       string    `json:"revision"`       // history revision of the applied config
+}
+
+func (p *PendingApply) SecondsLeft() int {
+	return max(0, int(time.Until(p.Deadline).Seconds()))
+}
+
+var pending struct {
+	sync.Mutex
+	apply *PendingApply
+	timer *time.Timer
+}
+
+func pendingPath() string {
+	return nixDir + "configuration.pending"
+}
+
+// currentGeneration returns the profile link the system profile points at, e.g. "system-42-link"
+func currentGeneration() string {
+	link, err := os.Readlink(systemProfile)
+	if err != nil {
+		slog.Debug("Error reading system profile link", "err", err)
+		return ""
+	}
+	return link
+}
+
+// restoreConfig puts every module's .old back and, if the failed switch already activated a new
+// generation, switches back to the one before it
+func restoreConfig(prevGeneration string) error {
+	slog.Debug("restoreConfig()", "prevGeneration", prevGeneration)
+
+	slog.Info("Restoring previous modules...")
+	if err := restoreModules(); err != nil {
+		return err
+	}
+
+	if current := currentGeneration(); current == prevGeneration {
+		slog.Info("No new generation was activated, nothing to roll back.")
+		return nil
+	}
+
+	slog.Info("Switching back to the previous generation...")
+	out, err := runCommand(context.Background(), nixDir, "nixos-rebuild", "switch", "--rollback")
+	if err != nil {
+		slog.Debug("| error running 'nixos-rebuild switch --rollback' |", "output", string(out), "err", err)
+		return fmt.Errorf("failed to roll back: %w", err)
+	}
+
+	slog.Info("Rollback completed successfully.")
+	return nil
+}
+
+// applyWithRollback switches in the saved modules and rebuilds. If the rebuild fails the old config is
+// restored straight away, otherwise the change waits for confirmation.
+func applyWithRollback(actor string) (*PendingApply, error) {
+	slog.Debug("applyWithRollback()")
+	unlock, err := lockSystem()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if getPending() != nil {
+		return nil, errPending
+	}
+	prevGeneration := currentGeneration()
+
+	rev, err := recordRevision(revisionNixOS, actor, "applying", savedRevisionFiles())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := switchConfig(); err != nil {
+		updateRevision(rev.ID, "failed", err.Error())
+		return nil, err
+	}
+
+	if err := applyChanges(); err != nil {
+		slog.Error("| Rebuild failed, rolling back |", "err", err)
+		if rollbackErr := restoreConfig(prevGeneration); rollbackErr != nil {
+			err = errors.Join(err, rollbackErr)
+			updateRevision(rev.ID, "failed", err.Error())
+			return nil, err
+		}
+		updateRevision(rev.ID, "failed", err.Error())
+		return nil, fmt.Errorf("%w (previous configuration restored)", err)
+	}
+
+	updateRevision(rev.ID, "awaiting confirmation", "")
+	apply := &PendingApply{Deadline: time.Now().Add(confirmWindow), PrevGeneration: prevGeneration, Revision: rev.ID}
+	if err := startPending(apply); err != nil {
+		return nil, err
+	}
+	return apply, nil
+}
+
+func startPending(apply *PendingApply) error {
+	b, err := json.Marshal(apply)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(pendingPath(), b, 0644); err != nil {
+		slog.Debug("Error writing pending apply file", "err", err)
+		return err
+	}
+
+	pending.Lock()
+	defer pending.Unlock()
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	pending.apply = apply
+	pending.timer = time.AfterFunc(time.Until(apply.Deadline), func() {
+		slog.Info("Configuration was not confirmed in time, rolling back")
+		if err := revertPending(); err != nil {
+			slog.Error("| Error rolling back unconfirmed configuration |", "err", err)
+		}
+	})
+	slog.Info("Waiting for configuration to be confirmed", "deadline", apply.Deadline)
+	return nil
+}
+
+// errPending refuses anything that switches the system while an applied config is waiting to be
+// confirmed. Switching would make that config permanent, or the rollback would undo the wrong change.
+var errPending = errors.New("an applied configuration is waiting to be confirmed, keep or revert it first")
+
+// systemLock is held by everything that switches, rebuilds or collects the system profile: apply, host
+// updates, generation switches, rollbacks and garbage collection. Two at once would race on the profile,
+// and a second apply would overwrite the .old files the first one rolls back to.
+var systemLock sync.Mutex
+
+var errBusy = errors.New("another system change is running, try again once it has finished")
+
+// lockSystem takes systemLock without waiting, so a second click gets errBusy instead of queueing up
+func lockSystem() (func(), error) {
+	if !systemLock.TryLock() {
+		return nil, errBusy
+	}
+	return systemLock.Unlock, nil
+}
+
+// pendingStatus is the HTTP status for an error that may be errPending or errBusy, which the admin can
+// resolve by confirming or waiting
+func pendingStatus(err error) int {
+	if errors.Is(err, errPending) || errors.Is(err, errBusy) {
+		return http.StatusConflict
+	}
+	return http.StatusInternalServerError
+}
+
+func getPending() *PendingApply {
+	pending.Lock()
+	defer pending.Unlock()
+	return pending.apply
+}
+
+// takePending clears the pending apply and returns it, or nil if there wasn't one
+func takePending() *PendingApply {
+	pending.Lock()
+	defer pending.Unlock()
+	apply := pending.apply
+	if pending.timer != nil {
+		pending.timer.Stop()
+	}
+	pending.apply, pending.timer = nil, nil
+	if err := os.Remove(pendingPath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		slog.Error("| Error removing pending apply file |", "err", err)
+	}
+	return apply
+}
+
+func confirmPending() bool {
+	if apply := takePending(); apply != nil {
+		slog.Info("Configuration confirmed")
+		updateRevision(apply.Revision, "applied", "")
+		syncConfirmedHostname(apply)
+		return true
+	}
+	return false
+}
+
+// syncConfirmedHostname updates Immich once a hostname change has stuck. Errors are only logged, the
+// NixOS side is already applied.
+func syncConfirmedHostname(apply *PendingApply) {
+	config, err := loadNixConfig(nixDir, ".nix")
+	if err != nil {
+		slog.Error("| Error reading applied config |", "err", err)
+		return
+	}
+	changed, err := syncImmichDomain(config.Hostname)
+	if err != nil {
+		slog.Error("| Error updating Immich external domain |", "err", err)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	actor := "unknown"
+	if rev, err := getRevision(apply.Revision); err == nil {
+		actor = rev.AppliedBy
+	}
+	saved, err := recordRevision(revisionImmich, actor, "saved", map[string]string{"immich-config.json": tankImmich + "immich-config.json"})
+	if err != nil {
+		slog.Error("| Failed to record Immich config revision |", "err", err)
+		return
+	}
+	updateRevision(saved.ID, "saved", "External domain follows hostname "+config.Hostname)
+}
+
+func revertPending() error {
+	apply := takePending()
+	if apply == nil {
+		return fmt.Errorf("no configuration is waiting for confirmation")
+	}
+	if err := restoreConfig(apply.PrevGeneration); err != nil {
+		updateRevision(apply.Revision, "rollback failed", err.Error())
+		return err
+	}
+	updateRevision(apply.Revision, "rolled back", "Not confirmed, previous configuration restored")
+	return nil
+}
+
+// resumePending picks up a confirmation window that was running when the service stopped
+func resumePending() {
+	b, err := os.ReadFile(pendingPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Error("| Error reading pending apply file |", "err", err)
+		return
+	}
+
+	var apply PendingApply
+	if err := json.Unmarshal(b, &apply); err != nil {
+		slog.Error("| Error parsing pending apply file |", "err", err)
+		return
+	}
+
+	// Give the admin at least a little time to get back to the page after a restart
+	if time.Until(apply.Deadline) < 30*time.Second {
+		apply.Deadline = time.Now().Add(30 * time.Second)
+	}
+	if err := startPending(&apply); err != nil {
+		slog.Error("| Error resuming pending apply |", "err", err)
+	}
+}
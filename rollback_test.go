@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestSystemChangesAreSerialized(t *testing.T) {
+	unlock, err := lockSystem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	if _, err := applyWithRollback("test"); !errors.Is(err, errBusy) {
+		t.Errorf("applyWithRollback() = %v", err)
+	}
+	if _, err := startHostUpdate(); !errors.Is(err, errBusy) {
+		t.Errorf("startHostUpdate() = %v", err)
+	}
+	if err := switchGeneration(1); !errors.Is(err, errBusy) {
+		t.Errorf("switchGeneration() = %v", err)
+	}
+	if err := rollbackGeneration(); !errors.Is(err, errBusy) {
+		t.Errorf("rollbackGeneration() = %v", err)
+	}
+	if err := collectGenerations(3); !errors.Is(err, errBusy) {
+		t.Errorf("collectGenerations() = %v", err)
+	}
+	if _, err := collectGarbage(30); !errors.Is(err, errBusy) {
+		t.Errorf("collectGarbage() = %v", err)
+	}
+	if status := pendingStatus(errBusy); status != http.StatusConflict {
+		t.Errorf("pendingStatus(errBusy) = %d", status)
+	}
+}
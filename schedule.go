@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Calendar is a parsed systemd calendar expression, the format system.autoUpgrade.dates takes (see
+// systemd.time(7)). It covers what OnCalendar= accepts apart from fractional seconds, so a schedule
+// that parses here won't be rejected by the timer.
+type Calendar struct {
+	weekdays []time.Weekday // nil means any day of the week
+	years    []int          // nil means any year
+	months   []int
+	days     []int
+	fromEnd  bool // days count back from the end of the month, "~"
+	hours    []int
+	minutes  []int
+	seconds  []int
+	location *time.Location // nil means the system timezone
+}
+
+var calendarShorthands = map[string]string{
+	"minutely":     "*-*-* *:*:00",
+	"hourly":       "*-*-* *:00:00",
+	"daily":        "*-*-* 00:00:00",
+	"weekly":       "Mon *-*-* 00:00:00",
+	"monthly":      "*-*-01 00:00:00",
+	"quarterly":    "*-01,04,07,10-01 00:00:00",
+	"semiannually": "*-01,07-01 00:00:00",
+	"yearly":       "*-01-01 00:00:00",
+	"annually":     "*-01-01 00:00:00",
+}
+
+// systemd's week starts on Monday, which matters for ranges like Sat..Sun
+var weekdayNames = []string{"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday"}
+
+func parseCalendar(expr string) (*Calendar, error) {
+	fields := strings.Fields(expr)
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("schedule is empty")
+	}
+	c := &Calendar{}
+
+	// A trailing timezone, "UTC" or a zoneinfo name
+	if last := fields[len(fields)-1]; len(fields) > 1 && last != "Local" {
+		if loc, err := time.LoadLocation(last); err == nil {
+			c.location = loc
+			fields = fields[:len(fields)-1]
+		}
+	}
+	if len(fields) == 1 {
+		if full, ok := calendarShorthands[strings.ToLower(fields[0])]; ok {
+			fields = strings.Fields(full)
+		}
+	}
+
+	hasWeekdays := false
+	if first := fields[0][0]; (first >= 'a' && first <= 'z') || (first >= 'A' && first <= 'Z') {
+		weekdays, err := parseWeekdays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		c.weekdays = weekdays
+		fields = fields[1:]
+		hasWeekdays = true
+	}
+
+	date, clock := "*-*-*", "00:00:00"
+	switch {
+	case len(fields) == 2:
+		date, clock = fields[0], fields[1]
+	case len(fields) == 1 && strings.Contains(fields[0], ":"):
+		clock = fields[0]
+	case len(fields) == 1:
+		date = fields[0]
+	case len(fields) == 0 && hasWeekdays:
+	default:
+		return nil, fmt.Errorf("%q is not a calendar expression, expected something like \"Mon..Fri *-*-* 02:00\"", expr)
+	}
+	if err := c.parseDate(date); err != nil {
+		return nil, fmt.Errorf("%q: %w", expr, err)
+	}
+	if err := c.parseClock(clock); err != nil {
+		return nil, fmt.Errorf("%q: %w", expr, err)
+	}
+	return c, nil
+}
+
+// parseWeekdays reads a list of days and ranges such as "Mon,Wed..Fri"
+func parseWeekdays(field string) ([]time.Weekday, error) {
+	index := func(name string) (int, error) {
+		name = strings.ToLower(name)
+		for i, day := range weekdayNames {
+			if name == day || name == day[:3] {
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("%q is not a day of the week", name)
+	}
+
+	var weekdays []time.Weekday
+	for _, item := range strings.Split(field, ",") {
+		from, to, isRange := strings.Cut(item, "..")
+		if !isRange {
+			from, to, isRange = strings.Cut(item, "-")
+		}
+		start, err := index(from)
+		if err != nil {
+			return nil, err
+		}
+		end := start
+		if isRange {
+			if end, err = index(to); err != nil {
+				return nil, err
+			}
+			if end < start {
+				return nil, fmt.Errorf("%q runs backwards, weeks start on Monday", item)
+			}
+		}
+		for i := start; i <= end; i++ {
+			weekdays = append(weekdays, time.Weekday((i+1)%7))
+		}
+	}
+	return weekdays, nil
+}
+
+// parseDate reads [year-]month-day, where the day may instead follow "~" to count from the end of
+// the month
+func (c *Calendar) parseDate(date string) error {
+	var parts []string
+	var day string
+	if before, after, ok := strings.Cut(date, "~"); ok {
+		parts, day, c.fromEnd = strings.Split(before, "-"), after, true
+	} else {
+		parts = strings.Split(date, "-")
+		parts, day = parts[:len(parts)-1], parts[len(parts)-1]
+	}
+
+	var err error
+	switch len(parts) {
+	case 2:
+		if parts[0] != "*" {
+			if c.years, err = parseCalendarValues(parts[0], "year", 1970, 2199); err != nil {
+				return err
+			}
+		}
+		fallthrough
+	case 1:
+		if c.months, err = parseCalendarValues(parts[len(parts)-1], "month", 1, 12); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("not a date, expected year-month-day")
+	}
+
+	if c.fromEnd {
+		c.days, err = parseLastDays(day)
+	} else {
+		c.days, err = parseCalendarValues(day, "day", 1, 31)
+	}
+	return err
+}
+
+// parseClock reads hour:minute[:second]
+func (c *Calendar) parseClock(clock string) error {
+	parts := strings.Split(clock, ":")
+	if len(parts) == 2 {
+		parts = append(parts, "00")
+	}
+	if len(parts) != 3 {
+		return fmt.Errorf("not a time, expected hour:minute[:second]")
+	}
+	if strings.Contains(strings.ReplaceAll(parts[2], "..", ""), ".") {
+		return fmt.Errorf("fractional seconds are not supported")
+	}
+
+	var err error
+	if c.hours, err = parseCalendarValues(parts[0], "hour", 0, 23); err != nil {
+		return err
+	}
+	if c.minutes, err = parseCalendarValues(parts[1], "minute", 0, 59); err != nil {
+		return err
+	}
+	c.seconds, err = parseCalendarValues(parts[2], "second", 0, 59)
+	return err
+}
+
+// parseCalendarValues expands one component: "*", a value, a range "a..b", or a list of them, each
+// optionally repeating with "/step". "5/10" repeats from 5 to the end of the range.
+func parseCalendarValues(field string, name string, min int, max int) ([]int, error) {
+	var values []int
+	for _, item := range strings.Split(field, ",") {
+		item, stepText, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return nil, fmt.Errorf("%q is not a valid repetition", stepText)
+			}
+		}
+
+		from, to := min, max
+		if item != "*" {
+			fromText, toText, isRange := strings.Cut(item, "..")
+			var err error
+			if from, err = strconv.Atoi(fromText); err != nil {
+				return nil, fmt.Errorf("%q is not a valid %s", fromText, name)
+			}
+			switch {
+			case isRange:
+				if to, err = strconv.Atoi(toText); err != nil {
+					return nil, fmt.Errorf("%q is not a valid %s", toText, name)
+				}
+			case !hasStep:
+				to = from
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, fmt.Errorf("%s %q is out of range, expected %d to %d", name, item, min, max)
+		}
+		for v := from; v <= to; v += step {
+			values = append(values, v)
+		}
+	}
+	slices.Sort(values)
+	return slices.Compact(values), nil
+}
+
+// parseLastDays reads the days after "~", 1 being the last day of the month. A repetition walks
+// towards the end of the month, so "~07/1" is each of the last seven days.
+func parseLastDays(field string) ([]int, error) {
+	var days []int
+	for _, item := range strings.Split(field, ",") {
+		fromText, stepText, hasStep := strings.Cut(item, "/")
+		if !hasStep || strings.Contains(fromText, "..") {
+			values, err := parseCalendarValues(item, "day", 1, 31)
+			if err != nil {
+				return nil, err
+			}
+			days = append(days, values...)
+			continue
+		}
+		from, err := strconv.Atoi(fromText)
+		if err != nil || from < 1 || from > 31 {
+			return nil, fmt.Errorf("%q is not a valid day", fromText)
+		}
+		step, err := strconv.Atoi(stepText)
+		if err != nil || step < 1 {
+			return nil, fmt.Errorf("%q is not a valid repetition", stepText)
+		}
+		for d := from; d >= 1; d -= step {
+			days = append(days, d)
+		}
+	}
+	slices.Sort(days)
+	return slices.Compact(days), nil
+}
+
+func (c *Calendar) matchesDay(day time.Time) bool {
+	if c.weekdays != nil && !slices.Contains(c.weekdays, day.Weekday()) {
+		return false
+	}
+	if c.years != nil && !slices.Contains(c.years, day.Year()) {
+		return false
+	}
+	if !slices.Contains(c.months, int(day.Month())) {
+		return false
+	}
+	if c.fromEnd {
+		last := time.Date(day.Year(), day.Month()+1, 0, 0, 0, 0, 0, day.Location()).Day()
+		return slices.Contains(c.days, last-day.Day()+1)
+	}
+	return slices.Contains(c.days, day.Day())
+}
+
+// Next returns up to n times the calendar elapses after t. Times are in the calendar's timezone if it
+// names one, otherwise in t's.
+func (c *Calendar) Next(t time.Time, n int) []time.Time {
+	if c.location != nil {
+		t = t.In(c.location)
+	}
+	var runs []time.Time
+	start := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	// Something like "Mon *-02-29" can go decades between runs
+	for i := 0; i < 366*30 && len(runs) < n; i++ {
+		day := start.AddDate(0, 0, i)
+		if c.years != nil && day.Year() > c.years[len(c.years)-1] {
+			break
+		}
+		if !c.matchesDay(day) {
+			continue
+		}
+		for _, hour := range c.hours {
+			for _, minute := range c.minutes {
+				for _, second := range c.seconds {
+					run := time.Date(day.Year(), day.Month(), day.Day(), hour, minute, second, 0, t.Location())
+					if !run.After(t) {
+						continue
+					}
+					runs = append(runs, run)
+					if len(runs) == n {
+						return runs
+					}
+				}
+			}
+		}
+	}
+	return runs
+}
+
+// timespanUnits are the systemd.time(7) units randomizedDelaySec is likely to be given in
+var timespanUnits = map[string]time.Duration{
+	"":        time.Second,
+	"ms":      time.Millisecond,
+	"msec":    time.Millisecond,
+	"s":       time.Second,
+	"sec":     time.Second,
+	"second":  time.Second,
+	"seconds": time.Second,
+	"m":       time.Minute,
+	"min":     time.Minute,
+	"minute":  time.Minute,
+	"minutes": time.Minute,
+	"h":       time.Hour,
+	"hr":      time.Hour,
+	"hour":    time.Hour,
+	"hours":   time.Hour,
+	"d":       24 * time.Hour,
+	"day":     24 * time.Hour,
+	"days":    24 * time.Hour,
+	"w":       7 * 24 * time.Hour,
+	"week":    7 * 24 * time.Hour,
+	"weeks":   7 * 24 * time.Hour,
+}
+
+// parseTimespan reads a systemd time span such as "15min", "1h 30min" or "900" (seconds)
+func parseTimespan(span string) (time.Duration, error) {
+	rest := strings.TrimSpace(span)
+	if rest == "" {
+		return 0, fmt.Errorf("time span is empty")
+	}
+	var total time.Duration
+	for rest != "" {
+		digits := len(rest) - len(strings.TrimLeft(rest, "0123456789"))
+		if digits == 0 {
+			return 0, fmt.Errorf("%q is not a time span, expected something like \"15min\" or \"1h 30min\"", span)
+		}
+		value, _ := strconv.Atoi(rest[:digits])
+		rest = strings.TrimLeft(rest[digits:], " ")
+		letters := len(rest) - len(strings.TrimLeft(rest, "abcdefghijklmnopqrstuvwxyz"))
+		unit, ok := timespanUnits[rest[:letters]]
+		if !ok {
+			return 0, fmt.Errorf("%q is not a time unit", rest[:letters])
+		}
+		total += time.Duration(value) * unit
+		rest = strings.TrimLeft(rest[letters:], " ")
+	}
+	return total, nil
+}
+
+// defaultRebootWindow matches the half hour the reboot window used to be fixed at
+const defaultRebootWindow = 30
+
+// loadUpgradeSchedule reads the schedule, the randomized delay and the reboot window width. Older
+// system.nix files fixed the delay at 15min.
+func loadUpgradeSchedule(l *settingLoader, config *NixConfig) error {
+	config.UpgradeTime = "04:40" // system.autoUpgrade.dates' default
+	if err := l.String("UpgradeTime", "system.autoUpgrade.dates", &config.UpgradeTime); err != nil {
+		return err
+	}
+
+	config.UpgradeDelay = "15min"
+	if node := l.Optional("UpgradeDelay", "system.autoUpgrade.randomizedDelaySec"); node != nil {
+		delay, err := nixStringValue(node)
+		if err != nil {
+			return err
+		}
+		config.UpgradeDelay = delay
+	}
+
+	config.UpgradeWindow = defaultRebootWindow
+	lowerNode := l.Optional("UpgradeWindow", "system.autoUpgrade.rebootWindow.lower")
+	upperNode := l.Optional("UpgradeWindow", "system.autoUpgrade.rebootWindow.upper")
+	if lowerNode != nil && upperNode != nil {
+		lowerText, lowerErr := nixStringValue(lowerNode)
+		upperText, upperErr := nixStringValue(upperNode)
+		lower, lowerTimeErr := time.Parse("15:04", lowerText)
+		upper, upperTimeErr := time.Parse("15:04", upperText)
+		if lowerErr == nil && upperErr == nil && lowerTimeErr == nil && upperTimeErr == nil {
+			// The window may wrap past midnight
+			config.UpgradeWindow = int((upper.Sub(lower)+24*time.Hour)%(24*time.Hour)) / int(time.Minute)
+		}
+	}
+	return nil
+}
+
+// validateUpgradeSchedule checks the schedule will elapse, and the delay and reboot window make sense
+func validateUpgradeSchedule(settings SystemSettings) error {
+	cal, err := parseCalendar(settings.UpgradeTime)
+	if err != nil {
+		return err
+	}
+	if len(cal.Next(time.Now(), 1)) == 0 {
+		return fmt.Errorf("%q never elapses", settings.UpgradeTime)
+	}
+	if _, err := parseTimespan(settings.UpgradeDelay); err != nil {
+		return err
+	}
+	if settings.UpgradeWindow < 1 || settings.UpgradeWindow > 23*60 {
+		return fmt.Errorf("reboot window must be between 1 minute and 23 hours")
+	}
+	return nil
+}
+
+// NextUpgrades are the next five times the upgrade timer fires in the configured timezone, before the
+// randomized delay is added
+func (s SystemSettings) NextUpgrades() []time.Time {
+	cal, err := parseCalendar(s.UpgradeTime)
+	if err != nil {
+		return nil
+	}
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		loc = time.Local
+	}
+	return cal.Next(time.Now().In(loc), 5)
+}
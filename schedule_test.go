@@ -0,0 +1,108 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCalendarNext(t *testing.T) {
+	tests := []struct {
+		expr string
+		from string
+		want []string
+	}{
+		// Shorthands
+		{"daily", "2025-01-31T12:00:00Z", []string{"2025-02-01T00:00:00Z", "2025-02-02T00:00:00Z"}},
+		{"weekly", "2025-01-01T00:00:00Z", []string{"2025-01-06T00:00:00Z", "2025-01-13T00:00:00Z"}},
+		{"monthly", "2025-12-15T00:00:00Z", []string{"2026-01-01T00:00:00Z", "2026-02-01T00:00:00Z"}},
+		{"yearly", "2025-06-01T00:00:00Z", []string{"2026-01-01T00:00:00Z", "2027-01-01T00:00:00Z"}},
+		{"hourly", "2024-12-31T23:30:00Z", []string{"2025-01-01T00:00:00Z", "2025-01-01T01:00:00Z"}},
+
+		// Weekdays and ranges, weeks start on Monday
+		{"Sat..Sun 06:00", "2025-01-01T00:00:00Z", []string{"2025-01-04T06:00:00Z", "2025-01-05T06:00:00Z", "2025-01-11T06:00:00Z"}},
+		{"Mon,Wed..Fri 02:00", "2025-01-01T03:00:00Z", []string{"2025-01-02T02:00:00Z", "2025-01-03T02:00:00Z", "2025-01-06T02:00:00Z"}},
+		{"Fri-Sat *-*-* 23:00", "2025-01-01T00:00:00Z", []string{"2025-01-03T23:00:00Z", "2025-01-04T23:00:00Z"}},
+		{"Sun 02:00", "2025-01-05T02:00:00Z", []string{"2025-01-12T02:00:00Z"}},
+
+		// Days counted from the end of the month
+		{"*-*~01 23:00", "2025-01-15T00:00:00Z", []string{"2025-01-31T23:00:00Z", "2025-02-28T23:00:00Z", "2025-03-31T23:00:00Z"}},
+		{"*-02~01", "2027-06-01T00:00:00Z", []string{"2028-02-29T00:00:00Z"}},
+		{"*-*~03/2 12:00", "2025-01-01T00:00:00Z", []string{"2025-01-29T12:00:00Z", "2025-01-31T12:00:00Z", "2025-02-26T12:00:00Z"}},
+
+		// Month and year boundaries
+		{"*-*-31 12:00", "2025-01-31T13:00:00Z", []string{"2025-03-31T12:00:00Z", "2025-05-31T12:00:00Z"}},
+		{"*-12-31 23:59:59", "2025-12-31T23:59:59Z", []string{"2026-12-31T23:59:59Z"}},
+		{"*-02-29 00:00", "2025-03-01T00:00:00Z", []string{"2028-02-29T00:00:00Z"}},
+		{"2025-*-01 00:00", "2025-12-15T00:00:00Z", nil},
+
+		// Repetitions
+		{"*:0/20", "2025-01-31T23:50:00Z", []string{"2025-02-01T00:00:00Z", "2025-02-01T00:20:00Z"}},
+		{"02..04:00", "2025-01-01T03:00:00Z", []string{"2025-01-01T04:00:00Z", "2025-01-02T02:00:00Z"}},
+
+		// Timezones
+		{"02:00 Europe/Amsterdam", "2025-01-01T00:00:00Z", []string{"2025-01-01T02:00:00+01:00", "2025-01-02T02:00:00+01:00"}},
+		{"Mon 09:00 America/New_York", "2025-03-08T00:00:00Z", []string{"2025-03-10T09:00:00-04:00"}},
+		{"daily UTC", "2025-01-01T12:00:00+09:00", []string{"2025-01-02T00:00:00Z"}},
+		{"02:00", "2025-01-01T12:00:00+09:00", []string{"2025-01-02T02:00:00+09:00"}},
+	}
+	for _, test := range tests {
+		cal, err := parseCalendar(test.expr)
+		if err != nil {
+			t.Errorf("parseCalendar(%q): %v", test.expr, err)
+			continue
+		}
+		from, err := time.Parse(time.RFC3339, test.from)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, run := range cal.Next(from, max(len(test.want), 1)) {
+			got = append(got, run.Format(time.RFC3339))
+		}
+		if !slices.Equal(got, test.want) {
+			t.Errorf("%q after %s = %q, want %q", test.expr, test.from, got, test.want)
+		}
+	}
+}
+
+func TestParseCalendarErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"blursday",
+		"Sun..Mon 02:00",
+		"Mon *-*-* 25:00",
+		"*-13-01",
+		"*-*-32",
+		"*-*-* 02:00:00.5",
+		"02:00/0",
+		"Mon 1 2 3",
+	} {
+		if _, err := parseCalendar(expr); err == nil {
+			t.Errorf("parseCalendar(%q) should fail", expr)
+		}
+	}
+}
+
+func TestParseTimespan(t *testing.T) {
+	tests := []struct {
+		span string
+		want time.Duration
+	}{
+		{"15min", 15 * time.Minute},
+		{"1h 30min", 90 * time.Minute},
+		{"1h30m", 90 * time.Minute},
+		{"900", 15 * time.Minute},
+		{"2 days", 48 * time.Hour},
+	}
+	for _, test := range tests {
+		if got, err := parseTimespan(test.span); err != nil || got != test.want {
+			t.Errorf("parseTimespan(%q) = %v, %v, want %v", test.span, got, err, test.want)
+		}
+	}
+	for _, span := range []string{"", "min", "15 fortnights"} {
+		if _, err := parseTimespan(span); err == nil {
+			t.Errorf("parseTimespan(%q) should fail", span)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Immich sends its emails (password resets, album invites, backup alerts) through any SMTP server.
+// The presets only fill in the host and port, everything is still editable afterwards.
+
+type SMTPPreset struct {
+	ID       string
+	Name     string
+	Host     string
+	Port     int
+	Username string // fixed username some relays use with an API key as the password, otherwise empty
+	Help     string
+	HelpURL  string
+}
+
+var smtpPresets = []SMTPPreset{
+	{ID: "gmail", Name: "Gmail", Host: "smtp.gmail.com", Port: 587, Help: "Sign in with your Gmail address and an app password.", HelpURL: "https://support.google.com/mail/answer/185833"},
+	{ID: "outlook", Name: "Outlook / Microsoft 365", Host: "smtp.office365.com", Port: 587, Help: "Sign in with your Microsoft address. SMTP AUTH has to be allowed for the mailbox.", HelpURL: "https://learn.microsoft.com/en-us/exchange/clients-and-mobile-in-exchange-online/authenticated-client-smtp-submission"},
+	{ID: "icloud", Name: "iCloud Mail", Host: "smtp.mail.me.com", Port: 587, Help: "Sign in with your iCloud address and an app-specific password.", HelpURL: "https://support.apple.com/en-us/102654"},
+	{ID: "fastmail", Name: "Fastmail", Host: "smtp.fastmail.com", Port: 465, Help: "Sign in with your Fastmail address and an app password.", HelpURL: "https://www.fastmail.help/hc/en-us/articles/1500000278342"},
+	{ID: "sendgrid", Name: "SendGrid", Host: "smtp.sendgrid.net", Port: 587, Username: "apikey", Help: "The username is literally \"apikey\", the password is the API key.", HelpURL: "https://www.twilio.com/docs/sendgrid/for-developers/sending-email/integrating-with-the-smtp-api"},
+	{ID: "mailgun", Name: "Mailgun", Host: "smtp.mailgun.org", Port: 587, Help: "Use the SMTP credentials of your sending domain.", HelpURL: "https://documentation.mailgun.com/docs/mailgun/user-manual/sending-messages/send-smtp"},
+}
+
+// Preset returns the preset whose host the transport uses, if any
+func (t Transport) Preset() *SMTPPreset {
+	for i := range smtpPresets {
+		if strings.EqualFold(smtpPresets[i].Host, t.Host) {
+			return &smtpPresets[i]
+		}
+	}
+	return nil
+}
+
+func applySMTPPreset(smtp *SMTP, id string) {
+	for _, preset := range smtpPresets {
+		if preset.ID != id {
+			continue
+		}
+		smtp.Transport.Host = preset.Host
+		smtp.Transport.Port = preset.Port
+		if preset.Username != "" {
+			smtp.Transport.Username = preset.Username
+		}
+	}
+}
+
+// parseSMTPForm applies the email form to smtp. An empty password keeps the one already set, unless
+// the host or username changed, so a password is never sent to a server it wasn't entered for.
+func parseSMTPForm(r *http.Request, smtp *SMTP) error {
+	previous := smtp.Transport
+	smtp.Enabled = parseBool(r.FormValue("smtp-enabled"))
+	smtp.Transport.Host = strings.ToLower(strings.TrimSpace(r.FormValue("smtp-host")))
+	smtp.Transport.Username = strings.TrimSpace(r.FormValue("smtp-username"))
+	smtp.Transport.IgnoreCert = parseBool(r.FormValue("smtp-ignore-cert"))
+	smtp.From = strings.TrimSpace(r.FormValue("smtp-from"))
+	smtp.ReplyTo = strings.TrimSpace(r.FormValue("smtp-reply-to"))
+	if password := r.FormValue("smtp-password"); password != "" {
+		smtp.Transport.Password = password
+	} else if smtp.Transport.Host != previous.Host || smtp.Transport.Username != previous.Username {
+		smtp.Transport.Password = ""
+	}
+
+	// Most providers only let you send as the account you sign in with
+	if smtp.From == "" {
+		if _, err := mail.ParseAddress(smtp.Transport.Username); err == nil {
+			smtp.From = "Immich Server <" + smtp.Transport.Username + ">"
+		}
+	}
+
+	port := strings.TrimSpace(r.FormValue("smtp-port"))
+	if port == "" {
+		smtp.Transport.Port = 0
+		return nil
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("SMTP port %q is not a number", port)
+	}
+	smtp.Transport.Port = n
+	return nil
+}
+
+var smtpHostRe = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// validateSMTP checks the values that are set, and that an enabled server has everything it needs
+func validateSMTP(smtp SMTP) error {
+	var errs []error
+	transport := smtp.Transport
+	if transport.Host != "" && !smtpHostRe.MatchString(transport.Host) && net.ParseIP(transport.Host) == nil {
+		errs = append(errs, fmt.Errorf("SMTP host %q is not a hostname or IP address", transport.Host))
+	}
+	if transport.Port < 0 || transport.Port > 65535 {
+		errs = append(errs, fmt.Errorf("SMTP port must be between 1 and 65535"))
+	}
+	if smtp.From != "" {
+		if _, err := mail.ParseAddress(smtp.From); err != nil {
+			errs = append(errs, fmt.Errorf("from address %q must look like \"Immich <immich@example.com>\" or immich@example.com", smtp.From))
+		}
+	}
+	if smtp.ReplyTo != "" {
+		if _, err := mail.ParseAddress(smtp.ReplyTo); err != nil {
+			errs = append(errs, fmt.Errorf("reply-to address %q is not an email address", smtp.ReplyTo))
+		}
+	}
+
+	if smtp.Enabled {
+		if transport.Host == "" || transport.Port == 0 {
+			errs = append(errs, fmt.Errorf("sending email needs an SMTP host and port"))
+		}
+		if smtp.From == "" {
+			errs = append(errs, fmt.Errorf("sending email needs a from address"))
+		}
+		if transport.Username != "" && transport.Password == "" {
+			errs = append(errs, fmt.Errorf("SMTP user %s needs a password", transport.Username))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f ImmichForm) SMTPPresets() []SMTPPreset {
+	return smtpPresets
+}
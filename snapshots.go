@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sanoid snapshot retention, one policy per dataset in services.sanoid.datasets. Each is recursive,
+// so a child without its own policy (tank/immich/library) follows the closest parent that has one.
+
+type SnapshotPolicy struct {
+	Dataset  string
+	Hourly   int
+	Daily    int
+	Weekly   int
+	Monthly  int
+	Yearly   int
+	Estimate *SnapshotEstimate // only set by loadCurrentConfig
+}
+
+// SnapshotEstimate is a worst case for the space a policy ends up holding: everything written during
+// the retention period, as if all of it were deleted or overwritten again
+type SnapshotEstimate struct {
+	Snapshots       int      // currently kept
+	UsedBySnapshots ByteSize // space they hold now
+	DailyChange     ByteSize // average written per day between the recent snapshots
+	Retained        ByteSize // DailyChange over RetentionDays
+}
+
+// The datasets from docs/setup/storage.md. tank/immich and tank/pgdata start out with tank's policy,
+// which is what they followed before they could be set separately.
+var snapshotDatasets = []string{"tank", "tank/immich", "tank/pgdata"}
+
+var defaultSnapshotPolicy = SnapshotPolicy{Dataset: "tank", Hourly: 24, Daily: 7}
+
+var datasetRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:/-]*$`)
+
+// RetentionDays is how far back the oldest snapshot the policy keeps reaches
+func (p SnapshotPolicy) RetentionDays() float64 {
+	return max(float64(p.Hourly)/24, float64(p.Daily), float64(p.Weekly)*7, float64(p.Monthly)*30, float64(p.Yearly)*365)
+}
+
+// loadSnapshots reads services.sanoid.datasets, then adds any of snapshotDatasets the file doesn't
+// have with tank's policy
+func loadSnapshots(l *settingLoader, config *NixConfig) error {
+	config.Snapshots = nil
+	if set, ok := l.Optional("Snapshots", "services.sanoid.datasets").(*NixAttrSet); ok {
+		for _, binding := range set.Bindings {
+			path, ok := binding.staticPath()
+			attrs, isSet := nixUnwrapAttrs(binding.Value).(*NixAttrSet)
+			if !ok || len(path) != 1 || !isSet {
+				continue
+			}
+			policy := SnapshotPolicy{Dataset: path[0]}
+			counts := []struct {
+				name string
+				dst  *int
+			}{
+				{"hourly", &policy.Hourly},
+				{"daily", &policy.Daily},
+				{"weekly", &policy.Weekly},
+				{"monthly", &policy.Monthly},
+				{"yearly", &policy.Yearly},
+			}
+			for _, count := range counts {
+				node := nixLookupPath(attrs, []string{count.name})
+				if node == nil {
+					continue
+				}
+				n, ok := nixUnwrapModifiers(node).(*NixInt)
+				if !ok {
+					return fmt.Errorf("%s: expected an integer", node.Pos())
+				}
+				*count.dst = int(n.Value)
+			}
+			config.Snapshots = append(config.Snapshots, policy)
+		}
+	}
+
+	base := defaultSnapshotPolicy
+	for _, policy := range config.Snapshots {
+		if policy.Dataset == "tank" {
+			base = policy
+		}
+	}
+	for _, dataset := range snapshotDatasets {
+		found := false
+		for _, policy := range config.Snapshots {
+			found = found || policy.Dataset == dataset
+		}
+		if !found {
+			policy := base
+			policy.Dataset = dataset
+			config.Snapshots = append(config.Snapshots, policy)
+		}
+	}
+	return nil
+}
+
+// parseSnapshotForm reads the retention fields, snap-<dataset>-hourly and so on for each posted dataset
+func parseSnapshotForm(r *http.Request) ([]SnapshotPolicy, error) {
+	var policies []SnapshotPolicy
+	var errs []error
+	for _, dataset := range r.Form["dataset"] {
+		policy := SnapshotPolicy{Dataset: dataset}
+		counts := []struct {
+			name string
+			dst  *int
+		}{
+			{"hourly", &policy.Hourly},
+			{"daily", &policy.Daily},
+			{"weekly", &policy.Weekly},
+			{"monthly", &policy.Monthly},
+			{"yearly", &policy.Yearly},
+		}
+		for _, count := range counts {
+			value := strings.TrimSpace(r.FormValue("snap-" + dataset + "-" + count.name))
+			if value == "" {
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %s snapshots %q is not a number", dataset, count.name, value))
+				continue
+			}
+			*count.dst = n
+		}
+		policies = append(policies, policy)
+	}
+	return policies, errors.Join(errs...)
+}
+
+func validateSnapshots(policies []SnapshotPolicy) error {
+	var errs []error
+	for _, policy := range policies {
+		if !datasetRe.MatchString(policy.Dataset) {
+			errs = append(errs, fmt.Errorf("%q is not a ZFS dataset name", policy.Dataset))
+		}
+		for _, n := range []int{policy.Hourly, policy.Daily, policy.Weekly, policy.Monthly, policy.Yearly} {
+			if n < 0 || n > 1000 {
+				errs = append(errs, fmt.Errorf("%s: snapshot counts must be between 0 and 1000", policy.Dataset))
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// estimateSnapshots fills in each policy's Estimate from the dataset's existing snapshots. Datasets
+// that don't exist yet, or have fewer than two snapshots, are left without one.
+func estimateSnapshots(policies []SnapshotPolicy) {
+	for i := range policies {
+		estimate, err := estimateSnapshot(policies[i])
+		if err != nil {
+			slog.Debug("Error estimating snapshot space", "dataset", policies[i].Dataset, "err", err)
+			continue
+		}
+		policies[i].Estimate = estimate
+	}
+}
+
+func estimateSnapshot(policy SnapshotPolicy) (*SnapshotEstimate, error) {
+	ctx := context.Background()
+	// written is what changed between a snapshot and the one before it
+	out, err := runCommand(ctx, "/", "zfs", "list", "-Hp", "-t", "snapshot", "-o", "creation,written", "-s", "creation", "-d", "1", policy.Dataset)
+	if err != nil {
+		return nil, fmt.Errorf("zfs list failed: %w", err)
+	}
+	type snapshot struct {
+		created time.Time
+		written uint64
+	}
+	var snapshots []snapshot
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		created, err1 := strconv.ParseInt(fields[0], 10, 64)
+		written, err2 := strconv.ParseUint(fields[1], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot{time.Unix(created, 0), written})
+	}
+	if len(snapshots) < 2 {
+		return nil, fmt.Errorf("not enough snapshots")
+	}
+
+	out, err = runCommand(ctx, "/", "zfs", "get", "-Hp", "-o", "value", "usedbysnapshots", policy.Dataset)
+	if err != nil {
+		return nil, fmt.Errorf("zfs get failed: %w", err)
+	}
+	used, _ := strconv.ParseUint(strings.TrimSpace(string(out)), 10, 64)
+
+	// Average over the last week of snapshots. The first one's written covers the time before it.
+	recent := snapshots
+	cutoff := snapshots[len(snapshots)-1].created.AddDate(0, 0, -7)
+	for len(recent) > 2 && recent[1].created.Before(cutoff) {
+		recent = recent[1:]
+	}
+	var written uint64
+	for _, s := range recent[1:] {
+		written += s.written
+	}
+	days := recent[len(recent)-1].created.Sub(recent[0].created).Hours() / 24
+	if days <= 0 {
+		return nil, fmt.Errorf("snapshots were all taken at once")
+	}
+	daily := float64(written) / days
+
+	return &SnapshotEstimate{
+		Snapshots:       len(snapshots),
+		UsedBySnapshots: ByteSize(used),
+		DailyChange:     ByteSize(daily),
+		Retained:        ByteSize(daily * policy.RetentionDays()),
+	}, nil
+}
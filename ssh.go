@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// SSHSettings are rendered into ssh.nix. Keys go on a single admin user, root by default since that's
+// who the web UI runs as.
+type SSHSettings struct {
+	SSH             bool
+	SSHUser         string
+	SSHPasswordAuth bool
+	AuthorizedKeys  []string // one OpenSSH public key per entry, "type base64 [comment]"
+}
+
+var sshKeyTypes = []string{
+	"ssh-ed25519",
+	"ssh-rsa",
+	"ecdsa-sha2-nistp256",
+	"ecdsa-sha2-nistp384",
+	"ecdsa-sha2-nistp521",
+	"sk-ssh-ed25519@openssh.com",
+	"sk-ecdsa-sha2-nistp256@openssh.com",
+}
+
+var usernameRe = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// validateAuthorizedKey checks that a line is a public key OpenSSH will accept: a known type, base64
+// that decodes to a key blob of that same type, and an optional comment. Options such as from="..."
+// aren't supported.
+func validateAuthorizedKey(key string) error {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return fmt.Errorf("%q is not a public key, expected something like \"ssh-ed25519 AAAA... user@host\"", abbreviate(key))
+	}
+	keyType, data := fields[0], fields[1]
+	if !slices.Contains(sshKeyTypes, keyType) {
+		return fmt.Errorf("%q is not a supported key type", keyType)
+	}
+	blob, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return fmt.Errorf("%s key %q is not valid base64", keyType, abbreviate(data))
+	}
+	// The blob starts with the key type as a length-prefixed string
+	if len(blob) < 4 {
+		return fmt.Errorf("%s key %q is truncated", keyType, abbreviate(data))
+	}
+	n := binary.BigEndian.Uint32(blob)
+	if uint64(len(blob)) < 4+uint64(n) || !bytes.Equal(blob[4:4+n], []byte(keyType)) {
+		return fmt.Errorf("%s key %q does not contain a %s key", keyType, abbreviate(data), keyType)
+	}
+	// The key ends up in a Nix string
+	if strings.ContainsAny(key, "\"\\$") {
+		return fmt.Errorf("%s key comment can't contain quotes, backslashes or $", keyType)
+	}
+	return nil
+}
+
+func abbreviate(s string) string {
+	if len(s) > 24 {
+		return s[:20] + "..."
+	}
+	return s
+}
+
+// parseAuthorizedKeys splits the textarea into keys, one per line, ignoring blank lines and # comments
+func parseAuthorizedKeys(text string) []string {
+	var keys []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keys = append(keys, line)
+	}
+	return keys
+}
+
+func validateSSH(settings SSHSettings) error {
+	var errs []error
+	if !usernameRe.MatchString(settings.SSHUser) {
+		errs = append(errs, fmt.Errorf("%q is not a valid user name", settings.SSHUser))
+	}
+	for _, key := range settings.AuthorizedKeys {
+		if err := validateAuthorizedKey(key); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if settings.SSH && !settings.SSHPasswordAuth && len(settings.AuthorizedKeys) == 0 {
+		errs = append(errs, fmt.Errorf("with password authentication disabled at least one authorized key is needed to log in over SSH"))
+	}
+	return errors.Join(errs...)
+}
+
+// checkSSHUser refuses an SSH user that users.nix doesn't define. ssh.nix only adds keys to the account,
+// so anyone but root has to exist there first, and removing a user that still receives the keys is
+// refused the same way. The keys in both modules are lists, which NixOS concatenates.
+func checkSSHUser(config *NixConfig) error {
+	if config.SSHUser == "root" {
+		return nil
+	}
+	for _, user := range config.Users {
+		if user.Name == config.SSHUser {
+			return nil
+		}
+	}
+	return fmt.Errorf("SSH user %s is not root or a user on the Users page", config.SSHUser)
+}
+
+// loadSSH reads ssh.nix. The user isn't known up front, so the keys are found by looking for the
+// users.users.<name>.openssh.authorizedKeys.keys binding.
+func loadSSH(l *settingLoader, config *NixConfig) error {
+	config.SSHPasswordAuth = true // OpenSSH's default in NixOS
+	if err := l.Bool("SSH", "services.openssh.enable", &config.SSH); err != nil {
+		return err
+	}
+	if err := l.Bool("SSHPasswordAuth", "services.openssh.settings.PasswordAuthentication", &config.SSHPasswordAuth); err != nil {
+		return err
+	}
+
+	config.SSHUser, config.AuthorizedKeys = "root", nil
+	for _, binding := range nixModuleAttrs(l.file.Root).Bindings {
+		path, ok := binding.staticPath()
+		if !ok || len(path) != 6 || path[0] != "users" || path[1] != "users" || strings.Join(path[3:], ".") != "openssh.authorizedKeys.keys" {
+			continue
+		}
+		list, ok := nixUnwrapModifiers(binding.Value).(*NixList)
+		if !ok {
+			return fmt.Errorf("%s: expected a list of keys", binding.Value.Pos())
+		}
+		config.SSHUser = path[2]
+		for _, elem := range list.Elems {
+			key, err := nixStringValue(elem)
+			if err != nil {
+				return err
+			}
+			config.AuthorizedKeys = append(config.AuthorizedKeys, key)
+		}
+		l.sources["AuthorizedKeys"] = SettingSource{File: l.file.Path, Line: binding.Pos().Line}
+		break
+	}
+	return nil
+}
+
+// sshDefaults are the options ssh.nix sets with lib.mkDefault. admin.nix has set some of them since
+// before the web UI managed SSH, which is fine as long as it agrees, otherwise it quietly wins.
+var sshDefaults = []string{
+	"services.openssh.enable",
+	"services.openssh.openFirewall",
+	"services.openssh.settings.PasswordAuthentication",
+	"services.openssh.settings.KbdInteractiveAuthentication",
+	"services.openssh.settings.PermitRootLogin",
+}
+
+// checkAdminOverrides refuses an admin.nix in dir that sets an SSH option to something other than ssh.nix does
+func checkAdminOverrides(dir string) error {
+	admin, err := parseNixFile(filepath.Join(dir, "admin.nix"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ssh, err := parseNixFile(filepath.Join(dir, "ssh.nix"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var overridden []string
+	for _, option := range sshDefaults {
+		value := nixLookup(admin.Root, option)
+		if value == nil {
+			continue
+		}
+		adminValue, ok := nixLiteral(value)
+		if sshValue, sshOK := nixLiteral(nixLookup(ssh.Root, option)); !ok || !sshOK || adminValue != sshValue {
+			overridden = append(overridden, fmt.Sprintf("%s (line %d)", option, value.Pos().Line))
+		}
+	}
+	if len(overridden) > 0 {
+		return fmt.Errorf("admin.nix overrides the SSH settings with %s, remove them from admin.nix", strings.Join(overridden, ", "))
+	}
+	return nil
+}
+
+// nixLiteral renders a bool or string value for comparison
+func nixLiteral(node NixNode) (string, bool) {
+	if node == nil {
+		return "", false
+	}
+	if value, err := nixBoolValue(node); err == nil {
+		return strconv.FormatBool(value), true
+	}
+	if value, err := nixStringValue(node); err == nil {
+		return strconv.Quote(value), true
+	}
+	return "", false
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckSSHUser(t *testing.T) {
+	users := UserSettings{Users: []OSUser{{Name: "admin", Admin: true}}}
+	tests := []struct {
+		user string
+		ok   bool
+	}{
+		{"root", true},
+		{"admin", true},
+		{"nobody", false},
+	}
+	for _, test := range tests {
+		config := &NixConfig{UserSettings: users, SSHSettings: SSHSettings{SSHUser: test.user}}
+		if err := checkSSHUser(config); (err == nil) != test.ok {
+			t.Errorf("checkSSHUser(%q) = %v", test.user, err)
+		}
+	}
+}
+
+// admin.nix may repeat what ssh.nix sets, but not change it
+func TestCheckAdminOverrides(t *testing.T) {
+	ssh, err := os.ReadFile("example/etc/nixos/ssh.nix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		admin string
+		want  string
+	}{
+		{"{ services.openssh.enable = true; services.openssh.settings.PermitRootLogin = \"yes\"; }", ""},
+		{"{ pkgs, ... }: { environment.systemPackages = [ pkgs.git ]; }", ""},
+		{"{\n  services.openssh.settings.PasswordAuthentication = false;\n}", "admin.nix overrides the SSH settings with services.openssh.settings.PasswordAuthentication (line 2)"},
+		{"{ services.openssh = { enable = lib.mkForce false; }; }", "services.openssh.enable (line 1)"},
+		{"{ services.openssh.settings.PermitRootLogin = if true then \"yes\" else \"no\"; }", "services.openssh.settings.PermitRootLogin"},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "ssh.nix"), ssh, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, "admin.nix"), []byte(test.admin), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := checkAdminOverrides(dir)
+		if test.want == "" && err != nil {
+			t.Errorf("%s: %v", test.admin, err)
+		}
+		if test.want != "" && (err == nil || !strings.Contains(err.Error(), test.want)) {
+			t.Errorf("%s: error = %v, want %s", test.admin, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, pkgs, ... }:
+
+{
+  virtualisation.docker.enable = true;
+  virtualisation.docker.autoPrune.enable = true;
+  virtualisation.docker.autoPrune.dates = "monthly";
+
+  environment.systemPackages = with pkgs; [
+    wget
+  ];
+
+  # Testing with non-root user for immich. Still not fully-baked
+  # users.groups.immich = {};
+  # users.users.immich = {
+  #   isSystemUser = true;
+  #   group = "immich";
+  #   description = "Immich";
+  #   extraGroups = [ "docker" ];
+  # };
+
+  # expects docker-compose.yml and .env file for Immich to be stored in /root/immich-app
+  # Didn't quite get the systemd service to check and pull this working but decided against it as I'll be managing this through templates contained within the Go binary
+  systemd.services.immich-app = {
+    description = "Manage Immich Compose Stack";
+    requires = [ "docker.service" ];
+    after = [ "docker.service" ];
+    wantedBy = [ "multi-user.target" ];
+
+    serviceConfig = {
+      Type = "simple";
+      ExecStart = "${pkgs.docker}/bin/docker compose up";
+      ExecStop = "${pkgs.docker}/bin/docker compose down";
+      Restart = "always";
+      WorkingDirectory = "/root/immich-app";
+      TimeoutStopSec = "90";
+    };
+  };
+}
@@ -0,0 +1,49 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, pkgs, ... }:
+
+{
+  networking.hostName = "immich";
+  # networking.domain = ".local";
+  # networking.enableIPv6 = false;
+  # boot.kernel.sysctl."net.ipv6.conf.all.disable_ipv6" = true;
+
+  # Avahi (mDNS)
+  services.avahi.enable = true;
+  services.avahi = {
+    openFirewall = true;
+    hostName = "immich";
+    publish = {
+      #userServices = true;
+      enable = true;
+      #domain = true;
+      addresses = true;
+      #workstation = true;
+    };
+    extraServiceFiles = {
+      immich = ''
+        <service-group>
+          <name replace-wildcards="yes">%h</name>
+          <service>
+           <type>_http._tcp</type>
+           <port>80</port>
+          </service>
+        </service-group>
+      '';
+    };
+  };
+
+  # Caddy (reverse proxy)
+  services.caddy.enable = true;
+  services.caddy = {
+    virtualHosts."immich.local:80".extraConfig = ''
+      reverse_proxy http://localhost:2283
+    '';
+    virtualHosts.":8080".extraConfig = ''
+      reverse_proxy http://localhost:8000
+    '';
+  };
+
+  networking.firewall.allowPing = true;
+  networking.firewall.allowedTCPPorts = [ 80 8080 ];
+  networking.firewall.allowedUDPPorts = [ ];
+}
@@ -0,0 +1,68 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, pkgs, ... }:
+
+{
+# #Systemd service for go app stored in /root
+    # systemd.services.webui = {
+    #     description = "NixOS-Immich WebUI Service";
+    #     after = [ "network.target" ];
+    #     wantedBy = [ "multi-user.target" ];
+    #     serviceConfig = {
+    #         ExecStart = "/root/ezimmich";
+    #         Restart = "always";
+    #         User = "root";
+    #         WorkingDirectory = "/root";
+    #         StandardOutput = "journal";
+    #         StandardError = "journal";
+    #     };
+    # };
+
+  time.timeZone = "America/New_York";
+
+  # ====== Locale ======
+  i18n.defaultLocale = "en_US.UTF-8";
+  i18n.extraLocaleSettings = {
+    LC_ADDRESS = "en_US.UTF-8";
+    LC_IDENTIFICATION = "en_US.UTF-8";
+    LC_MEASUREMENT = "en_US.UTF-8";
+    LC_MONETARY = "en_US.UTF-8";
+    LC_NAME = "en_US.UTF-8";
+    LC_NUMERIC = "en_US.UTF-8";
+    LC_PAPER = "en_US.UTF-8";
+    LC_TELEPHONE = "en_US.UTF-8";
+    LC_TIME = "en_US.UTF-8";
+  };
+  services.xserver.xkb = {
+    layout = "us";
+    variant = "";
+  };
+  console.useXkbConfig = true;
+
+# #Enable Unattended Upgrades
+  system.autoUpgrade.enable = false;
+  system.autoUpgrade.dates = "02:00";
+  system.autoUpgrade = {
+    # flake = inputs.self.outPath;
+    flags = [
+      "--update-input"
+      "nixpkgs"
+      "-L" # print build logs
+    ];
+    randomizedDelaySec = "15min";
+  };
+  system.autoUpgrade.allowReboot = false;
+  system.autoUpgrade.rebootWindow.lower = "02:30";
+  system.autoUpgrade.rebootWindow.upper = "03:00";
+
+  # ====== Nix store ======
+  # Old generations keep their packages in the store, collect them so they don't fill the boot drive
+  nix.gc = {
+    automatic = false;
+    dates = "weekly";
+    options = "--delete-older-than 30d";
+  };
+
+  # ====== Backups =======
+  services.udisks2.enable = true;
+  environment.systemPackages = with pkgs; [ zip ];
+}
@@ -0,0 +1,29 @@
+# Managed by the web UI - changes made here will be overwritten. Put your own settings in admin.nix.
+{ config, pkgs, ... }:
+
+{
+  networking.hostId = "12345678"; # must not change once tank is imported
+
+  boot.supportedFilesystems = [ "zfs" ];
+  boot.zfs.forceImportRoot = false;
+  boot.zfs.extraPools = [ "tank" ];
+
+  services.zfs.autoScrub.enable = true;
+
+  services.sanoid.enable = true;
+  services.sanoid  = {
+    interval = "hourly";
+    datasets = {
+      "tank" = {
+        recursive = true;
+        autoprune = true;
+        autosnap = true;
+        hourly = 24;
+        daily = 7;
+        weekly = 0;
+        monthly = 0;
+        yearly = 0;
+      };
+    };
+  };
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A test email goes through the SMTP server the same way Immich would use it: implicit TLS on 465,
+// otherwise STARTTLS when the server offers it. Each step is reported so a wrong port, certificate
+// or app password shows up as the step that failed rather than as a silent missing email.
+
+const smtpTestTimeout = 30 * time.Second
+
+// smtpDial opens the connection, a variable so the test can be pointed at a fake server
+var smtpDial = (&net.Dialer{Timeout: 10 * time.Second}).DialContext
+
+type SMTPStep struct {
+	Name   string
+	Detail string
+	Err    string
+}
+
+type SMTPTestResult struct {
+	To    string
+	Steps []SMTPStep
+}
+
+func (r SMTPTestResult) OK() bool {
+	return len(r.Steps) > 0 && r.Steps[len(r.Steps)-1].Err == ""
+}
+
+func (r *SMTPTestResult) step(name, detail string, err error) error {
+	step := SMTPStep{Name: name, Detail: detail}
+	if err != nil {
+		step.Err = err.Error()
+	}
+	r.Steps = append(r.Steps, step)
+	return err
+}
+
+// loginAuth is AUTH LOGIN, which Microsoft's servers offer instead of PLAIN
+type loginAuth struct {
+	username, password string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch strings.ToLower(strings.TrimSuffix(string(fromServer), ":")) {
+	case "username":
+		return []byte(a.username), nil
+	case "password":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected server challenge %q", fromServer)
+}
+
+// sendTestEmail sends a short message to to with config, stopping at the first step that fails
+func sendTestEmail(ctx context.Context, config SMTP, to string) SMTPTestResult {
+	slog.Debug("sendTestEmail()", "host", config.Transport.Host, "to", to)
+	result := SMTPTestResult{To: to}
+	if err := testEmail(ctx, config, to, &result); err != nil {
+		slog.Error("| Test email failed |", "err", err)
+	} else {
+		slog.Info("Test email sent", "to", to)
+	}
+	return result
+}
+
+func testEmail(ctx context.Context, config SMTP, to string, result *SMTPTestResult) error {
+	transport := config.Transport
+	if transport.Host == "" || transport.Port == 0 {
+		return result.step("Settings", "", fmt.Errorf("no SMTP host and port are saved"))
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return result.step("Settings", "", fmt.Errorf("from address %q: %w", config.From, err))
+	}
+	recipient, err := mail.ParseAddress(to)
+	if err != nil {
+		return result.step("Settings", "", fmt.Errorf("recipient %q: %w", to, err))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, smtpTestTimeout)
+	defer cancel()
+
+	address := net.JoinHostPort(transport.Host, strconv.Itoa(transport.Port))
+	tlsConfig := &tls.Config{ServerName: transport.Host, InsecureSkipVerify: transport.IgnoreCert}
+	implicitTLS := transport.Port == 465
+
+	conn, err := smtpDial(ctx, "tcp", address)
+	if err != nil {
+		return result.step("Connect", address, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	detail := address
+	if implicitTLS {
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return result.step("Connect", address+" over TLS", err)
+		}
+		conn = tlsConn
+		detail += " over TLS"
+	}
+	result.step("Connect", detail, nil)
+
+	client, err := smtp.NewClient(conn, transport.Host)
+	if err != nil {
+		return result.step("Greeting", "", err)
+	}
+	defer client.Close()
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "localhost"
+	}
+	if err := client.Hello(hostname); err != nil {
+		return result.step("EHLO", hostname, err)
+	}
+	result.step("EHLO", hostname, nil)
+
+	if !implicitTLS {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return result.step("STARTTLS", "", err)
+			}
+			result.step("STARTTLS", "connection encrypted", nil)
+		} else {
+			result.step("STARTTLS", "not offered, continuing unencrypted", nil)
+		}
+	}
+
+	if transport.Username != "" {
+		mechanisms := ""
+		if ok, params := client.Extension("AUTH"); ok {
+			mechanisms = params
+		}
+		var auth smtp.Auth
+		switch {
+		case strings.Contains(mechanisms, "PLAIN"):
+			auth = smtp.PlainAuth("", transport.Username, transport.Password, transport.Host)
+		case strings.Contains(mechanisms, "LOGIN"):
+			auth = &loginAuth{transport.Username, transport.Password}
+		default:
+			return result.step("AUTH", transport.Username, fmt.Errorf("server offers no PLAIN or LOGIN authentication (%q)", mechanisms))
+		}
+		if err := client.Auth(auth); err != nil {
+			return result.step("AUTH", transport.Username, err)
+		}
+		result.step("AUTH", transport.Username, nil)
+	}
+
+	if err := client.Mail(from.Address); err != nil {
+		return result.step("MAIL FROM", from.Address, err)
+	}
+	result.step("MAIL FROM", from.Address, nil)
+	if err := client.Rcpt(recipient.Address); err != nil {
+		return result.step("RCPT TO", recipient.Address, err)
+	}
+	result.step("RCPT TO", recipient.Address, nil)
+
+	w, err := client.Data()
+	if err != nil {
+		return result.step("DATA", "", err)
+	}
+	if _, err := w.Write(testEmailMessage(config, from, recipient)); err != nil {
+		return result.step("DATA", "", err)
+	}
+	if err := w.Close(); err != nil {
+		return result.step("DATA", "", err)
+	}
+	result.step("DATA", "message accepted", nil)
+
+	if err := client.Quit(); err != nil {
+		return result.step("QUIT", "", err)
+	}
+	return result.step("QUIT", "", nil)
+}
+
+func testEmailMessage(config SMTP, from, to *mail.Address) []byte {
+	now := time.Now()
+	hostname, _ := os.Hostname()
+	headers := []string{
+		"From: " + from.String(),
+		"To: " + to.String(),
+		"Subject: Immich test email",
+		"Date: " + now.Format(time.RFC1123Z),
+		fmt.Sprintf("Message-ID: <%d.immich-webui@%s>", now.UnixNano(), from.Address[strings.LastIndex(from.Address, "@")+1:]),
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=utf-8",
+	}
+	if config.ReplyTo != "" {
+		headers = append(headers, "Reply-To: "+config.ReplyTo)
+	}
+	body := "This is a test email from the admin panel on " + hostname + ".\r\n" +
+		"Immich sends its emails through the same server, so they will arrive too.\r\n"
+	return []byte(strings.Join(headers, "\r\n") + "\r\n\r\n" + body)
+}
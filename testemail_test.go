@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeSMTP is a minimal SMTP server offering STARTTLS and AUTH PLAIN/LOGIN for one connection
+type fakeSMTP struct {
+	cert        tls.Certificate
+	implicitTLS bool
+	username    string
+	password    string
+	message     chan string
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	if s.implicitTLS {
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{s.cert}})
+		if tlsConn.Handshake() != nil {
+			return
+		}
+		conn = tlsConn
+	}
+	encrypted := s.implicitTLS
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake.example.com ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg, _ := strings.Cut(line, " ")
+		switch strings.ToUpper(verb) {
+		case "EHLO":
+			text.PrintfLine("250-fake.example.com")
+			if !encrypted {
+				text.PrintfLine("250-STARTTLS")
+			}
+			text.PrintfLine("250 AUTH PLAIN LOGIN")
+		case "STARTTLS":
+			text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{s.cert}})
+			if tlsConn.Handshake() != nil {
+				return
+			}
+			conn, encrypted = tlsConn, true
+			text = textproto.NewConn(conn)
+		case "AUTH":
+			_, initial, _ := strings.Cut(arg, " ")
+			credentials, _ := base64.StdEncoding.DecodeString(initial)
+			if string(credentials) == "\x00"+s.username+"\x00"+s.password {
+				text.PrintfLine("235 2.7.0 Authentication successful")
+			} else {
+				text.PrintfLine("535 5.7.8 Username and Password not accepted")
+			}
+		case "MAIL", "RCPT":
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			body, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.message <- string(body)
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// startFakeSMTP points smtpDial at a fake server, whatever host and port the settings name
+func startFakeSMTP(t *testing.T, server *fakeSMTP) {
+	t.Helper()
+	// httptest's self-signed certificate, which nothing trusts
+	https := httptest.NewUnstartedServer(nil)
+	https.StartTLS()
+	server.cert = https.TLS.Certificates[0]
+	https.Close()
+	server.message = make(chan string, 1)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		server.serve(conn)
+	}()
+
+	dial := smtpDial
+	smtpDial = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return dial(ctx, network, listener.Addr().String())
+	}
+	t.Cleanup(func() { smtpDial = dial })
+}
+
+func testSMTPSettings(port int, password string, ignoreCert bool) SMTP {
+	return SMTP{
+		Enabled: true,
+		From:    "Immich <immich@example.com>",
+		Transport: Transport{
+			Host:       "smtp.example.com",
+			Port:       port,
+			Username:   "immich@example.com",
+			Password:   password,
+			IgnoreCert: ignoreCert,
+		},
+	}
+}
+
+func stepNames(result SMTPTestResult) []string {
+	var names []string
+	for _, step := range result.Steps {
+		names = append(names, step.Name)
+	}
+	return names
+}
+
+func TestSendTestEmail(t *testing.T) {
+	tests := []struct {
+		name        string
+		port        int
+		password    string
+		ignoreCert  bool
+		steps       string // every step that ran, the last one is where it stopped
+		failure     string // in the last step's error, empty if the email was sent
+		stepDetails map[string]string
+	}{
+		{
+			name:        "STARTTLS",
+			port:        587,
+			password:    "secret",
+			ignoreCert:  true,
+			steps:       "Connect EHLO STARTTLS AUTH MAIL FROM RCPT TO DATA QUIT",
+			stepDetails: map[string]string{"STARTTLS": "connection encrypted", "DATA": "message accepted"},
+		},
+		{
+			name:        "implicit TLS",
+			port:        465,
+			password:    "secret",
+			ignoreCert:  true,
+			steps:       "Connect EHLO AUTH MAIL FROM RCPT TO DATA QUIT",
+			stepDetails: map[string]string{"Connect": "over TLS"},
+		},
+		{
+			name:       "wrong password",
+			port:       587,
+			password:   "wrong",
+			ignoreCert: true,
+			steps:      "Connect EHLO STARTTLS AUTH",
+			failure:    "Username and Password not accepted",
+		},
+		{
+			name:     "untrusted certificate",
+			port:     587,
+			password: "secret",
+			steps:    "Connect EHLO STARTTLS",
+			failure:  "certificate",
+		},
+		{
+			name:     "untrusted certificate on connect",
+			port:     465,
+			password: "secret",
+			steps:    "Connect",
+			failure:  "certificate",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &fakeSMTP{implicitTLS: test.port == 465, username: "immich@example.com", password: "secret"}
+			startFakeSMTP(t, server)
+
+			result := sendTestEmail(context.Background(), testSMTPSettings(test.port, test.password, test.ignoreCert), "me@example.com")
+			if steps := strings.Join(stepNames(result), " "); steps != test.steps {
+				t.Errorf("steps = %s, want %s", steps, test.steps)
+			}
+			for i, step := range result.Steps[:len(result.Steps)-1] {
+				if step.Err != "" {
+					t.Errorf("step %d %s failed: %s", i, step.Name, step.Err)
+				}
+			}
+			for _, step := range result.Steps {
+				if detail, ok := test.stepDetails[step.Name]; ok && !strings.Contains(step.Detail, detail) {
+					t.Errorf("%s detail = %q, want %q", step.Name, step.Detail, detail)
+				}
+			}
+
+			last := result.Steps[len(result.Steps)-1]
+			if test.failure == "" {
+				if !result.OK() {
+					t.Errorf("%s failed: %s", last.Name, last.Err)
+				}
+				message := <-server.message
+				if !strings.Contains(message, "Subject: Immich test email") || !strings.Contains(message, "To: <me@example.com>") {
+					t.Errorf("unexpected message:\n%s", message)
+				}
+				return
+			}
+			if result.OK() || !strings.Contains(last.Err, test.failure) {
+				t.Errorf("%s error = %q, want %q", last.Name, last.Err, test.failure)
+			}
+		})
+	}
+}
+
+func TestSendTestEmailSettings(t *testing.T) {
+	result := sendTestEmail(context.Background(), SMTP{}, "me@example.com")
+	if len(result.Steps) != 1 || result.Steps[0].Name != "Settings" || result.OK() {
+		t.Errorf("unsaved settings should stop at Settings: %+v", result.Steps)
+	}
+}
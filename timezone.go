@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Where the zoneinfo database lives. NixOS links it at /etc/zoneinfo, most other distros (and dev
+// machines) have /usr/share/zoneinfo.
+var zoneinfoDirs = []string{"/etc/zoneinfo", "/usr/share/zoneinfo", "/usr/share/lib/zoneinfo"}
+
+// listTimezones returns every zone name in the first zoneinfo directory found, sorted. The database
+// only changes with a tzdata update, so it's read once.
+var listTimezones = sync.OnceValues(func() ([]string, error) {
+	dirs := zoneinfoDirs
+	if env := os.Getenv("ZONEINFO"); env != "" {
+		dirs = append([]string{env}, dirs...)
+	}
+	for _, dir := range dirs {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			continue
+		}
+		zones, err := readZoneinfo(dir)
+		if err != nil {
+			return nil, err
+		}
+		slog.Debug("Loaded timezones", "dir", dir, "count", len(zones))
+		return zones, nil
+	}
+	return nil, fmt.Errorf("no zoneinfo database found in %s", strings.Join(dirs, ", "))
+})
+
+// readZoneinfo walks a zoneinfo directory and returns the name of every TZif file. The posix/ and
+// right/ trees are duplicates of the main one and are skipped, as is localtime.
+func readZoneinfo(dir string) ([]string, error) {
+	// On NixOS /etc/zoneinfo is a symlink into the store, and WalkDir doesn't follow a symlinked root
+	dir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		slog.Debug("Error resolving zoneinfo", "dir", dir, "err", err)
+		return nil, err
+	}
+	var zones []string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if name == "posix" || name == "right" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if name == "localtime" || name == "posixrules" || !isTZif(path) {
+			return nil
+		}
+		zones = append(zones, filepath.ToSlash(name))
+		return nil
+	})
+	if err != nil {
+		slog.Debug("Error reading zoneinfo", "dir", dir, "err", err)
+		return nil, err
+	}
+	if len(zones) == 0 {
+		return nil, fmt.Errorf("no timezones found in %s", dir)
+	}
+	slices.Sort(zones)
+	return zones, nil
+}
+
+func isTZif(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := f.Read(magic); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, []byte("TZif"))
+}
+
+func validateTimezone(zone string) error {
+	zones, err := listTimezones()
+	if err != nil {
+		return err
+	}
+	if _, found := slices.BinarySearch(zones, zone); !found {
+		return fmt.Errorf("%q is not a timezone in the zoneinfo database", zone)
+	}
+	return nil
+}
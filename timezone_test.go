@@ -0,0 +1,59 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// writeZoneinfo builds a small zoneinfo tree: two zones, the posix/ duplicate and localtime
+func writeZoneinfo(t *testing.T, dir string) {
+	t.Helper()
+	tzif := []byte("TZif2\x00\x00\x00")
+	files := map[string][]byte{
+		"UTC":                 tzif,
+		"America/New_York":    tzif,
+		"posix/UTC":           tzif,
+		"localtime":           tzif,
+		"zone.tab":            []byte("# not a zone\n"),
+		"Europe/Not_A_Zone.x": []byte("nope"),
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadZoneinfo(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "zoneinfo")
+	writeZoneinfo(t, target)
+	// NixOS: /etc/zoneinfo -> /nix/store/...-tzdata/share/zoneinfo
+	link := filepath.Join(dir, "etc-zoneinfo")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"America/New_York", "UTC"}
+	for _, path := range []string{target, link} {
+		zones, err := readZoneinfo(path)
+		if err != nil {
+			t.Fatalf("readZoneinfo(%s): %v", path, err)
+		}
+		if !slices.Equal(zones, want) {
+			t.Errorf("readZoneinfo(%s) = %v, want %v", path, zones, want)
+		}
+	}
+}
+
+func TestReadZoneinfoEmpty(t *testing.T) {
+	if zones, err := readZoneinfo(t.TempDir()); err == nil {
+		t.Errorf("readZoneinfo(empty dir) = %v, want an error", zones)
+	}
+}
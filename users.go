@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// The appliance's Unix users live in users.nix. Passwords are only ever stored as mkpasswd hashes, a
+// user without one keeps whatever password they already have (users.mutableUsers is left on).
+
+type OSUser struct {
+	Name           string
+	Description    string
+	Admin          bool   // member of wheel
+	HashedPassword string // empty leaves the current password alone
+	AuthorizedKeys []string
+}
+
+type UserSettings struct {
+	Users []OSUser
+}
+
+// hashPassword is a variable so dev machines without mkpasswd can swap in a fake
+var hashPassword = mkpasswd
+
+var passwordHashRe = regexp.MustCompile(`^\$[0-9a-z]+\$[./0-9A-Za-z$=,-]+$`)
+
+func mkpasswd(password string) (string, error) {
+	slog.Debug("mkpasswd()")
+	// Password on stdin so it doesn't show up in the process list
+	cmd := exec.Command("mkpasswd", "--method=yescrypt", "--stdin")
+	cmd.Stdin = strings.NewReader(password)
+	out, err := cmd.Output()
+	if errors.Is(err, exec.ErrNotFound) {
+		return "", fmt.Errorf("mkpasswd is not installed yet, apply the configuration once without passwords first")
+	}
+	if err != nil {
+		slog.Debug("| error running mkpasswd |", "err", err)
+		return "", fmt.Errorf("failed to hash password: %w", err)
+	}
+	hash := strings.TrimSpace(string(out))
+	if !passwordHashRe.MatchString(hash) {
+		return "", fmt.Errorf("mkpasswd returned an unexpected hash")
+	}
+	return hash, nil
+}
+
+// validateUsers checks every user and that at least one admin is left to run sudo
+func validateUsers(users []OSUser) error {
+	var errs []error
+	seen := map[string]bool{}
+	admins := 0
+	for _, user := range users {
+		if !usernameRe.MatchString(user.Name) || user.Name == "root" {
+			errs = append(errs, fmt.Errorf("%q is not a valid user name", user.Name))
+		}
+		if seen[user.Name] {
+			errs = append(errs, fmt.Errorf("user %s is listed twice", user.Name))
+		}
+		seen[user.Name] = true
+		if strings.ContainsAny(user.Description, "\"\\$\n") {
+			errs = append(errs, fmt.Errorf("%s: description can't contain quotes, backslashes or $", user.Name))
+		}
+		if user.HashedPassword != "" && !passwordHashRe.MatchString(user.HashedPassword) {
+			errs = append(errs, fmt.Errorf("%s: password hash is not in crypt format", user.Name))
+		}
+		for _, key := range user.AuthorizedKeys {
+			if err := validateAuthorizedKey(key); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", user.Name, err))
+			}
+		}
+		if user.Admin {
+			admins++
+		}
+	}
+	if admins == 0 {
+		errs = append(errs, fmt.Errorf("at least one user must be an admin"))
+	}
+	return errors.Join(errs...)
+}
+
+// loadUsers reads the users.users set users.nix writes. Installs from before users.nix have the
+// installer's `users.users.alice = { ... };` in configuration.nix, possibly spread over several dotted
+// bindings, so each user's attributes are gathered by name. Only normal users are managed here.
+func loadUsers(l *settingLoader, config *NixConfig) error {
+	config.Users = nil
+	set, ok := nixUnwrapAttrs(l.Optional("Users", "users.users")).(*NixAttrSet)
+	if !ok {
+		return nil
+	}
+	var names []string
+	for _, binding := range set.Bindings {
+		if path, ok := binding.staticPath(); ok && !slices.Contains(names, path[0]) {
+			names = append(names, path[0])
+		}
+	}
+	for _, name := range names {
+		attrs, ok := nixUnwrapAttrs(nixLookupPath(set, []string{name})).(*NixAttrSet)
+		if !ok {
+			continue
+		}
+		normal := nixLookupPath(attrs, []string{"isNormalUser"})
+		if normal == nil {
+			continue
+		}
+		if isNormal, err := nixBoolValue(normal); err != nil || !isNormal {
+			continue
+		}
+		user := OSUser{Name: name}
+		if node := nixLookupPath(attrs, []string{"description"}); node != nil {
+			user.Description, _ = nixStringValue(node)
+		}
+		if node := nixLookupPath(attrs, []string{"hashedPassword"}); node != nil {
+			user.HashedPassword, _ = nixStringValue(node)
+		}
+		if node := nixLookupPath(attrs, []string{"extraGroups"}); node != nil {
+			groups, err := nixStringList(node)
+			if err != nil {
+				return err
+			}
+			user.Admin = slices.Contains(groups, "wheel")
+		}
+		if node := nixLookupPath(attrs, []string{"openssh", "authorizedKeys", "keys"}); node != nil {
+			keys, err := nixStringList(node)
+			if err != nil {
+				return err
+			}
+			user.AuthorizedKeys = keys
+		}
+		config.Users = append(config.Users, user)
+	}
+	return nil
+}
+
+// parseUsersForm applies the users page to the current users. Existing users post their name in
+// "user" with fields prefixed user-<name>-, a new user is added from the new-user fields.
+func parseUsersForm(r *http.Request, current []OSUser) ([]OSUser, error) {
+	existing := map[string]OSUser{}
+	for _, user := range current {
+		existing[user.Name] = user
+	}
+
+	var users []OSUser
+	apply := func(user OSUser, prefix string) error {
+		user.Description = strings.TrimSpace(r.FormValue(prefix + "description"))
+		user.Admin = parseBool(r.FormValue(prefix + "admin"))
+		user.AuthorizedKeys = parseAuthorizedKeys(r.FormValue(prefix + "keys"))
+		if password := r.FormValue(prefix + "password"); password != "" {
+			if password != r.FormValue(prefix+"password-confirm") {
+				return fmt.Errorf("%s: passwords do not match", user.Name)
+			}
+			hash, err := hashPassword(password)
+			if err != nil {
+				return err
+			}
+			user.HashedPassword = hash
+		}
+		users = append(users, user)
+		return nil
+	}
+
+	for _, name := range r.Form["user"] {
+		user, ok := existing[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown user %q", name)
+		}
+		if parseBool(r.FormValue("user-" + name + "-remove")) {
+			slog.Info("Removing user", "user", name)
+			continue
+		}
+		if err := apply(user, "user-"+name+"-"); err != nil {
+			return nil, err
+		}
+	}
+
+	if name := strings.TrimSpace(r.FormValue("new-user")); name != "" {
+		if _, ok := existing[name]; ok {
+			return nil, fmt.Errorf("user %s already exists", name)
+		}
+		if err := apply(OSUser{Name: name}, "new-user-"); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandRunner runs an external command in dir and returns its combined output. It's a variable so
+// tests (and dev machines that aren't running NixOS) can swap in a fake nixos-rebuild.
+type commandRunner func(ctx context.Context, dir string, name string, args ...string) ([]byte, error)
+
+var runCommand commandRunner = execCommand
+
+func execCommand(ctx context.Context, dir string, name string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = dir
+	return cmd.CombinedOutput()
+}
+
+const validateTimeout = 30 * time.Minute // first build after an upgrade can download quite a bit
+
+// The option behind each NixConfig field, used to point evaluation errors at the form field they came from
+var settingOptions = map[string]string{
+	"TimeZone":        "time.timeZone",
+	"Locale":          "i18n.defaultLocale",
+	"Formats":         "i18n.extraLocaleSettings",
+	"Keymap":          "services.xserver.xkb",
+	"Hostname":        "networking.hostName",
+	"Interfaces":      "networking.networkmanager.ensureProfiles",
+	"TCPPorts":        "networking.firewall.allowedTCPPorts",
+	"UDPPorts":        "networking.firewall.allowedUDPPorts",
+	"AllowPing":       "networking.firewall.allowPing",
+	"AdminSubnets":    "networking.firewall.extraCommands",
+	"AutoUpgrade":     "system.autoUpgrade.enable",
+	"UpgradeTime":     "system.autoUpgrade.dates",
+	"UpgradeDelay":    "system.autoUpgrade.randomizedDelaySec",
+	"UpgradeWindow":   "system.autoUpgrade.rebootWindow",
+	"HostID":          "networking.hostId",
+	"Snapshots":       "services.sanoid.datasets",
+	"NixGC":           "nix.gc.automatic",
+	"NixGCDates":      "nix.gc.dates",
+	"NixGCDays":       "nix.gc.options",
+	"SSH":             "services.openssh.enable",
+	"SSHPasswordAuth": "services.openssh.settings",
+	"AuthorizedKeys":  "users.users",
+	"Users":           "users.users",
+	"Tailscale":       "services.tailscale",
+	"TSAuthkey":       "systemd.services.tailscale-autoconnect",
+}
+
+type ValidationResult struct {
+	Valid       bool
+	Output      string
+	Errors      []string          // errors that couldn't be tied to a specific field
+	FieldErrors map[string]string // NixConfig field name -> error
+}
+
+// Tracks which saved modules passed validation so apply can refuse anything else
+var validated struct {
+	sync.Mutex
+	hash  [32]byte
+	valid bool
+}
+
+// savedConfigHash hashes every module's .tmp, so a change to any one of them needs validating again
+func savedConfigHash() ([32]byte, error) {
+	h := sha256.New()
+	for _, module := range nixModules {
+		content, err := os.ReadFile(module.Path(nixDir, ".tmp"))
+		if err != nil {
+			return [32]byte{}, err
+		}
+		h.Write([]byte(module.Name))
+		h.Write(content)
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+func markValidated(hash [32]byte) {
+	validated.Lock()
+	defer validated.Unlock()
+	validated.hash = hash
+	validated.valid = true
+}
+
+// isValidated reports whether the saved modules are the ones that last passed validation
+func isValidated() bool {
+	hash, err := savedConfigHash()
+	if err != nil {
+		slog.Debug("Error reading saved modules", "err", err)
+		return false
+	}
+	validated.Lock()
+	defer validated.Unlock()
+	return validated.valid && validated.hash == hash
+}
+
+// copyNixDir copies everything in nixDir (hardware-configuration.nix and any modules) into the scratch
+// directory so the saved configuration can be built exactly as it would be on apply
+func copyNixDir(scratch string) error {
+	return filepath.WalkDir(nixDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(nixDir, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(scratch, rel), 0755)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		return CopyFile(path, filepath.Join(scratch, rel))
+	})
+}
+
+// validateConfig checks the saved modules before they're allowed to be applied. They're parsed, then
+// built with `nixos-rebuild build` in a scratch copy of the config directory, which evaluates every
+// option without touching the running system. In flake mode the build uses the saved flake.lock.
+func validateConfig(ctx context.Context) (*ValidationResult, error) {
+	slog.Debug("validateConfig()")
+	hash, err := savedConfigHash()
+	if err != nil {
+		slog.Debug("Error reading saved modules", "err", err)
+		return nil, err
+	}
+
+	scratch, err := os.MkdirTemp("", "nixos-validate-")
+	if err != nil {
+		slog.Debug("Error creating scratch directory", "err", err)
+		return nil, err
+	}
+	defer os.RemoveAll(scratch)
+
+	if err := copyNixDir(scratch); err != nil {
+		slog.Debug("Error copying config directory", "err", err)
+		return nil, err
+	}
+	// Errors should refer to the files the admin knows about rather than the scratch copies
+	var replacements []string
+	for _, module := range nixModules {
+		removed, err := isRemoved(module.Path(nixDir, ".tmp"))
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			if err := os.Remove(module.Path(scratch, ".nix")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+			continue
+		}
+		if err := CopyFile(module.Path(nixDir, ".tmp"), module.Path(scratch, ".nix")); err != nil {
+			slog.Debug("Error writing scratch module", "module", module.Name, "err", err)
+			return nil, err
+		}
+		replacements = append(replacements, module.Path(scratch, ".nix"), module.Path(nixDir, ".tmp"))
+	}
+	replacements = append(replacements, scratch+"/", nixDir)
+	tidy := strings.NewReplacer(replacements...).Replace
+
+	result := &ValidationResult{FieldErrors: map[string]string{}}
+
+	if err := checkModuleImports(scratch); err != nil {
+		slog.Debug("Base config is missing module imports", "err", err)
+		result.Errors = append(result.Errors, tidy(err.Error()))
+		return result, nil
+	}
+
+	config, err := loadNixConfig(scratch, ".nix")
+	if err != nil {
+		slog.Debug("Saved config failed to parse", "err", err)
+		result.Errors = append(result.Errors, tidy(err.Error()))
+		return result, nil
+	}
+
+	for _, module := range nixModules {
+		if module.Check == nil || !module.enabled(config) {
+			continue
+		}
+		if err := module.Check(config); err != nil {
+			slog.Debug("Saved config failed a module check", "module", module.Name, "err", err)
+			result.Errors = append(result.Errors, err.Error())
+		}
+	}
+	if len(result.Errors) > 0 {
+		return result, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, validateTimeout)
+	defer cancel()
+
+	slog.Info("Building saved configuration...")
+	out, err := runCommand(ctx, scratch, "nixos-rebuild", rebuildArgs(scratch, "build")...)
+	result.Output = summarizeOutput(tidy(string(out)), 40)
+	if err != nil {
+		slog.Debug("| nixos-rebuild build failed |", "err", err)
+		attributeErrors(result, string(out), scratch, config.Sources)
+		if len(result.Errors) == 0 && len(result.FieldErrors) == 0 {
+			result.Errors = append(result.Errors, fmt.Sprintf("nixos-rebuild build failed: %v", err))
+		}
+		for field, msg := range result.FieldErrors {
+			result.FieldErrors[field] = tidy(msg)
+		}
+		for i, msg := range result.Errors {
+			result.Errors[i] = tidy(msg)
+		}
+		return result, nil
+	}
+
+	slog.Info("Saved configuration built successfully.")
+	result.Valid = true
+	markValidated(hash)
+	return result, nil
+}
+
+var (
+	nixErrorRe  = regexp.MustCompile(`(?m)^[ \t]*error:[ \t]*(.+)$`)
+	nixOptionRe = regexp.MustCompile("option [`‘']([A-Za-z0-9_.\\-\"<>*]+)['’]")
+)
+
+// attributeErrors ties nixos-rebuild errors to form fields, either by the option named in the message
+// or by the line in a module in configDir the error points at
+func attributeErrors(result *ValidationResult, output string, configDir string, sources map[string]SettingSource) {
+	messages := nixErrorRe.FindAllStringSubmatch(output, -1)
+	if len(messages) == 0 {
+		return
+	}
+	// Nix prints the outermost error first, the useful one is usually the last
+	message := strings.TrimSpace(messages[len(messages)-1][1])
+
+	fields := map[string]bool{}
+	for _, match := range nixOptionRe.FindAllStringSubmatch(output, -1) {
+		for field, option := range settingOptions {
+			if match[1] == option || strings.HasPrefix(match[1], option+".") {
+				fields[field] = true
+			}
+		}
+	}
+
+	lineRe := regexp.MustCompile(regexp.QuoteMeta(configDir) + `/([\w.-]+\.nix):(\d+)(?::\d+)?`)
+	for _, match := range lineRe.FindAllStringSubmatch(output, -1) {
+		file := filepath.Join(configDir, match[1])
+		line, _ := strconv.Atoi(match[2])
+		for field, source := range sources {
+			if source.File == file && source.Line == line {
+				fields[field] = true
+			}
+		}
+	}
+
+	if len(fields) == 0 {
+		result.Errors = append(result.Errors, message)
+		return
+	}
+	for field := range fields {
+		result.FieldErrors[field] = message
+	}
+}
+
+// summarizeOutput trims build output down to the lines worth showing when there's a lot of it
+func summarizeOutput(output string, lines int) string {
+	all := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	if len(all) <= lines {
+		return output
+	}
+	return "...\n" + strings.Join(all[len(all)-lines:], "\n")
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeRebuild swaps runCommand for a nixos-rebuild that prints output(dir) and fails with err. The
+// scratch directory is only known once validateConfig runs, so the output is built from it.
+func fakeRebuild(t *testing.T, output func(dir string) string, err error) *[]string {
+	t.Helper()
+	var args []string
+	runCommand = func(ctx context.Context, dir string, name string, a ...string) ([]byte, error) {
+		if name != "nixos-rebuild" {
+			return nil, fmt.Errorf("%s is not available in tests", name)
+		}
+		args = a
+		return []byte(output(dir)), err
+	}
+	t.Cleanup(func() { runCommand = execCommand })
+	return &args
+}
+
+// useScratchNixDir points nixDir at a copy of the dev config in a temp dir, so tests can save and
+// apply without touching test/nixos
+func useScratchNixDir(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	entries, err := os.ReadDir(nixDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".nix" {
+			continue
+		}
+		if err := CopyFile(filepath.Join(nixDir, entry.Name()), filepath.Join(dir, entry.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := nixDir
+	nixDir = dir + "/"
+	t.Cleanup(func() { nixDir = previous })
+}
+
+// stageSavedConfig saves the dev config as it is, like pressing save without changes
+func stageSavedConfig(t *testing.T) *NixConfig {
+	t.Helper()
+	useScratchNixDir(t)
+	config, err := loadNixConfig(nixDir, ".nix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := saveTmpFile(config); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestValidateConfig(t *testing.T) {
+	config := stageSavedConfig(t)
+	hostname := config.Sources["Hostname"]
+	exitErr := errors.New("exit status 1")
+
+	tests := []struct {
+		name        string
+		output      func(dir string) string
+		err         error
+		fieldErrors map[string]string
+		errors      []string
+	}{
+		{
+			name:   "builds",
+			output: func(string) string { return "building the system configuration...\n" },
+		},
+		{
+			name: "option name",
+			output: func(string) string {
+				return "error:\n       … while evaluating the attribute 'config.system.build.toplevel'\n\n" +
+					"       error: The option `time.timeZone' has conflicting definition values\n"
+			},
+			err:         exitErr,
+			fieldErrors: map[string]string{"TimeZone": "The option `time.timeZone' has conflicting definition values"},
+		},
+		{
+			name: "file and line",
+			output: func(dir string) string {
+				return fmt.Sprintf("error: undefined variable 'hostnam'\n       at %s/networking.nix:%d:3:\n", dir, hostname.Line)
+			},
+			err:         exitErr,
+			fieldErrors: map[string]string{"Hostname": "undefined variable 'hostnam'"},
+		},
+		{
+			name:   "unattributed",
+			output: func(string) string { return "error: attribute 'immich' missing\n" },
+			err:    exitErr,
+			errors: []string{"attribute 'immich' missing"},
+		},
+		{
+			name:   "no error message",
+			output: func(string) string { return "killed\n" },
+			err:    exitErr,
+			errors: []string{"nixos-rebuild build failed: exit status 1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			args := fakeRebuild(t, test.output, test.err)
+			result, err := validateConfig(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Valid != (test.err == nil) {
+				t.Errorf("Valid = %v", result.Valid)
+			}
+			if result.Valid && !isValidated() {
+				t.Errorf("a config that built isn't marked as validated")
+			}
+			if len(*args) == 0 || (*args)[0] != "build" {
+				t.Errorf("nixos-rebuild was run with %q, want build", *args)
+			}
+			if len(result.FieldErrors) != len(test.fieldErrors) {
+				t.Errorf("FieldErrors = %q, want %q", result.FieldErrors, test.fieldErrors)
+			}
+			for field, msg := range test.fieldErrors {
+				if result.FieldErrors[field] != msg {
+					t.Errorf("FieldErrors[%s] = %q, want %q", field, result.FieldErrors[field], msg)
+				}
+			}
+			if !slices.Equal(result.Errors, test.errors) {
+				t.Errorf("Errors = %q, want %q", result.Errors, test.errors)
+			}
+		})
+	}
+}
+
+// Paths in the output point at the saved files, not the scratch copy that was built
+func TestValidateConfigTidiesPaths(t *testing.T) {
+	stageSavedConfig(t)
+	fakeRebuild(t, func(dir string) string {
+		return fmt.Sprintf("error: syntax error, unexpected '}'\n       at %s/admin.nix:9:1:\n", dir)
+	}, errors.New("exit status 1"))
+
+	result, err := validateConfig(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := filepath.Join(nixDir, "admin.nix") + ":9:1"
+	if !strings.Contains(result.Output, want) || strings.Contains(result.Output, "nixos-validate-") {
+		t.Errorf("Output = %q, want it to point at %s", result.Output, want)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ZFS refuses to import a pool at boot that was last imported by a host with a different hostId, so
+// every install needs its own and it must not change once tank is imported.
+
+const placeholderHostID = "12345678" // what the templates used to ship with
+
+// Variables so dev machines can point them at fixtures
+var (
+	hostIDFile    = "/etc/hostid"     // written by NixOS from networking.hostId
+	machineIDFile = "/etc/machine-id" // random per install, the NixOS manual suggests deriving hostId from it
+)
+
+var hostIDRe = regexp.MustCompile(`^[0-9a-f]{8}$`)
+
+// systemHostID returns the hostId the running system has, or "" if it doesn't have one. /etc/hostid
+// holds it as a little-endian 32-bit number.
+func systemHostID() string {
+	b, err := os.ReadFile(hostIDFile)
+	if err != nil || len(b) != 4 {
+		return ""
+	}
+	return fmt.Sprintf("%08x", binary.LittleEndian.Uint32(b))
+}
+
+// machineHostID derives a hostId from the first 8 hex digits of /etc/machine-id
+func machineHostID() (string, error) {
+	b, err := os.ReadFile(machineIDFile)
+	if err != nil {
+		slog.Debug("Error reading machine-id", "err", err)
+		return "", err
+	}
+	id := strings.TrimSpace(string(b))
+	if len(id) < 8 || !hostIDRe.MatchString(id[:8]) {
+		return "", fmt.Errorf("%s does not contain a machine ID", machineIDFile)
+	}
+	return id[:8], nil
+}
+
+// importedPools lists the pools currently imported. No zpool (a dev machine) means none.
+func importedPools() []string {
+	out, err := runCommand(context.Background(), "/", "zpool", "list", "-H", "-o", "name")
+	if err != nil {
+		slog.Debug("Error listing ZFS pools", "output", string(out), "err", err)
+		return nil
+	}
+	return strings.Fields(string(out))
+}
+
+// ensureHostID gives a config without a real hostId one. With a pool imported the running system's
+// hostId has to stay, even if it's the old placeholder, otherwise a fresh one comes from machine-id.
+func ensureHostID(config *NixConfig) error {
+	if hostIDRe.MatchString(config.HostID) && config.HostID != placeholderHostID {
+		return nil
+	}
+	if current := systemHostID(); current != "" && len(importedPools()) > 0 {
+		config.HostID = current
+		return nil
+	}
+	id, err := machineHostID()
+	if err != nil {
+		return err
+	}
+	slog.Info("Generated ZFS hostId from machine-id", "hostId", id)
+	config.HostID = id
+	return nil
+}
+
+// checkHostID refuses a hostId that differs from the one imported pools were imported with
+func checkHostID(config *NixConfig) error {
+	if !hostIDRe.MatchString(config.HostID) {
+		return fmt.Errorf("ZFS hostId %q must be 8 lowercase hex digits", config.HostID)
+	}
+	current := systemHostID()
+	if current == "" || current == config.HostID {
+		return nil
+	}
+	if pools := importedPools(); len(pools) > 0 {
+		return fmt.Errorf("ZFS hostId would change from %s to %s, pool %s would no longer import at boot", current, config.HostID, strings.Join(pools, ", "))
+	}
+	return nil
+}